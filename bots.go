@@ -0,0 +1,33 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains bots and crawlers detector
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isBot returns true when the request is most probably made by bot, crawler or link-preview fetcher:
+// it is HEAD request, request without user agent or request with user agent that contains any of patterns
+// (patterns are compared case-insensitive).
+func isBot(r *http.Request, patterns []string) bool {
+	if r.Method == http.MethodHead {
+		// browsers never make HEAD requests following the link, but link checkers and preview fetchers do
+		return true
+	}
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return true
+	}
+	for _, p := range patterns {
+		if strings.Contains(ua, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
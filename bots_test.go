@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsBot(t *testing.T) {
+	patterns := []string{"Bot", "facebookexternalhit", "curl"}
+	for _, tc := range []struct {
+		method string
+		ua     string
+		bot    bool
+	}{
+		{http.MethodGet, "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", false},
+		{http.MethodHead, "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", true},
+		{http.MethodGet, "TelegramBot (like TwitterBot)", true},
+		{http.MethodGet, "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{http.MethodGet, "curl/8.0.1", true},
+		{http.MethodGet, "", true},
+		{http.MethodGet, "SomeApp/1.0", false},
+	} {
+		r := httptest.NewRequest(tc.method, "/AAAAAA", nil)
+		r.Header.Set("User-Agent", tc.ua)
+		require.Equal(t, tc.bot, isBot(r, patterns), tc)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/AAAAAA", nil)
+	r.Header.Set("User-Agent", "curl/8.0.1")
+	require.False(t, isBot(r, nil))
+}
@@ -0,0 +1,125 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains TLS certificate loader with hot reload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// certCheckInterval is the period of certificate files modification check
+	certCheckInterval = 10 * time.Second
+)
+
+// certReloader holds the TLS certificate and reloads it when the certificate files are changed or SIGHUP is received.
+// Already established connections are not affected by reload: only new TLS handshakes get the new certificate.
+type certReloader struct {
+	certFile string                          // certificate file path
+	keyFile  string                          // private key file path
+	cert     atomic.Pointer[tls.Certificate] // current certificate
+	mu       sync.Mutex                      // serializes reloads
+	modTime  time.Time                       // the latest modification time of loaded files
+}
+
+// newCertReloader returns new certificate reloader for given certificate and key files
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+}
+
+// load reads the certificate and key files and replaces current certificate
+func (c *certReloader) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("TLS certificate loading error: %w", err)
+	}
+	c.cert.Store(&cert)
+	c.modTime = modTime
+	return nil
+}
+
+// changed returns true when any of certificate files was modified after the last load
+func (c *certReloader) changed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTime, err := c.filesModTime()
+	return err == nil && modTime.After(c.modTime)
+}
+
+// filesModTime returns the latest modification time of certificate and key files
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("TLS certificate file error: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch reloads the certificate on files modification or on SIGHUP until ctx is done
+func (c *certReloader) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+		case <-hup:
+		}
+		// keep the current certificate when the new one can't be loaded
+		if err := c.load(); err != nil {
+			log.Printf("TLS certificate reload error: %v", err)
+		} else {
+			log.Printf("TLS certificate reloaded from %s", c.certFile)
+		}
+	}
+}
+
+// GetCertificate returns current certificate for TLS handshake (it is tls.Config.GetCertificate callback)
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// leaf returns parsed current certificate
+func (c *certReloader) leaf() *x509.Certificate {
+	cert := c.cert.Load()
+	if cert == nil {
+		return nil
+	}
+	return cert.Leaf
+}
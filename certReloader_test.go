@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes self-signed certificate for localhost with given serial number into dir
+func writeTestCert(t *testing.T, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func Test03Cert00LoadError(t *testing.T) {
+	dir := t.TempDir()
+	c := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	require.Error(t, c.load())
+	require.Nil(t, c.leaf())
+
+	certFile, _ := writeTestCert(t, dir, 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"), []byte("garbage"), 0600))
+	c = newCertReloader(certFile, filepath.Join(dir, "key.pem"))
+	require.ErrorContains(t, c.load(), "TLS certificate loading error")
+}
+
+func Test03Cert05ReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	c := newCertReloader(certFile, keyFile)
+	require.NoError(t, c.load())
+	require.Equal(t, int64(1), c.leaf().SerialNumber.Int64())
+	require.False(t, c.changed())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.watch(ctx, 10*time.Millisecond)
+
+	// broken files don't replace the loaded certificate
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(1), c.leaf().SerialNumber.Int64())
+
+	writeTestCert(t, dir, 2)
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.Eventually(t, func() bool { return c.leaf().SerialNumber.Int64() == 2 }, time.Second, 10*time.Millisecond)
+}
+
+func Test03Cert10ReloadOnSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	c := newCertReloader(certFile, keyFile)
+	require.NoError(t, c.load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.watch(ctx, time.Hour)
+	time.Sleep(10 * time.Millisecond)
+
+	writeTestCert(t, dir, 3)
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool { return c.leaf().SerialNumber.Int64() == 3 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,147 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains clicks counter
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	clicksFlushInterval = time.Second // period of storing collected clicks into database
+	clicksQueueSize     = 10000       // maximum number of clicks waiting for collection
+)
+
+// click is a single redirect of token
+type click struct {
+	token     string
+	time      time.Time
+	referrer  string
+	userAgent string
+	ip        net.IP
+	bot       bool
+	variant   string
+}
+
+// clickCounter collects clicks in background and stores them into database by batches.
+// Collecting never blocks the redirect: the click is dropped when the queue is full.
+type clickCounter struct {
+	tokenDB TokenDB       // Database interface
+	geoIP   *geoIP        // GeoIP database, it can be nil
+	queue   chan click    // clicks waiting for collection
+	done    chan struct{} // closed when the last batch is stored after stop
+}
+
+// clicksBatch is the clicks collected between two storings
+type clicksBatch struct {
+	clicks map[string]Clicks
+	stats  map[string]ClickStats
+}
+
+// newClickCounter returns new clicks counter
+func newClickCounter(tokenDB TokenDB, geo *geoIP) *clickCounter {
+	return &clickCounter{
+		tokenDB: tokenDB,
+		geoIP:   geo,
+		queue:   make(chan click, clicksQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// count registers the click of token made by request r and redirected to the variant (it is empty for links
+// without variants), bot hits are counted separately
+func (c *clickCounter) count(sToken string, r *http.Request, bot bool, variant string) {
+	select {
+	case c.queue <- click{sToken, time.Now(), r.Referer(), r.UserAgent(), clientIP(r), bot, variant}:
+	default:
+		log.Printf("clicks queue is full: click of %s is dropped", sToken)
+	}
+}
+
+// run collects clicks and stores them every interval until ctx is done, then it stores the rest of clicks
+func (c *clickCounter) run(ctx context.Context, interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	batch := newClicksBatch()
+	for {
+		select {
+		case cl := <-c.queue:
+			c.collect(batch, cl)
+		case <-ticker.C:
+			batch = c.flush(batch)
+		case <-ctx.Done():
+			for {
+				select {
+				case cl := <-c.queue:
+					c.collect(batch, cl)
+				default:
+					c.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// newClicksBatch returns new empty batch
+func newClicksBatch() clicksBatch {
+	return clicksBatch{map[string]Clicks{}, map[string]ClickStats{}}
+}
+
+// collect adds the click into batch. The click details are parsed here to keep the redirect fast.
+func (c *clickCounter) collect(batch clicksBatch, cl click) {
+	stats := batch.stats[cl.token]
+	if stats == nil {
+		stats = ClickStats{}
+		batch.stats[cl.token] = stats
+	}
+	if cl.bot {
+		clicks := batch.clicks[cl.token]
+		clicks.Bots++
+		batch.clicks[cl.token] = clicks
+		stats.addBot(cl.time.UTC())
+		return
+	}
+	batch.clicks[cl.token] = batch.clicks[cl.token].add(cl.time)
+	stats.add(cl.time.UTC(), referrerHost(cl.referrer), uaClass(cl.userAgent), c.geoIP.country(cl.ip), cl.variant)
+}
+
+// flush stores the batch into database and returns new empty batch
+func (c *clickCounter) flush(batch clicksBatch) clicksBatch {
+	if len(batch.clicks) == 0 {
+		return batch
+	}
+	if err := c.tokenDB.AddClicks(batch.clicks); err != nil {
+		log.Printf("clicks storing error: %v", err)
+	}
+	if err := c.tokenDB.AddStats(batch.stats); err != nil {
+		log.Printf("clicks statistics storing error: %v", err)
+	}
+	return newClicksBatch()
+}
+
+// wait waits until the last batch is stored
+func (c *clickCounter) wait() {
+	<-c.done
+}
+
+// add returns statistics with one more (human) click made at given time
+func (c Clicks) add(t time.Time) Clicks {
+	if c.Count == 0 || t.Before(c.FirstSeen) {
+		c.FirstSeen = t
+	}
+	if t.After(c.LastSeen) {
+		c.LastSeen = t
+	}
+	c.Count++
+	return c
+}
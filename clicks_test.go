@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClicksAdd(t *testing.T) {
+	now := time.Now()
+	c := Clicks{}.add(now)
+	require.Equal(t, Clicks{Count: 1, FirstSeen: now, LastSeen: now}, c)
+	c = c.add(now.Add(time.Second)).add(now.Add(-time.Second))
+	require.Equal(t, Clicks{Count: 3, FirstSeen: now.Add(-time.Second), LastSeen: now.Add(time.Second)}, c)
+}
+
+func TestClickCounter(t *testing.T) {
+	db := newMockDB()
+	mu := sync.Mutex{}
+	stored := map[string]Clicks{}
+	db.addClicksFunc = func(clicks map[string]Clicks) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range clicks {
+			s := stored[k]
+			s.Count += v.Count
+			s.Bots += v.Bots
+			stored[k] = s
+		}
+		return nil
+	}
+	// counts returns clicks and bot hits counts by tokens
+	counts := func() map[string][2]int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		res := map[string][2]int64{}
+		for k, v := range stored {
+			res[k] = [2]int64{v.Count, v.Bots}
+		}
+		return res
+	}
+
+	storedStats := map[string]ClickStats{}
+	db.addStatsFunc = func(stats map[string]ClickStats) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range stats {
+			storedStats[k] = v
+		}
+		return nil
+	}
+	req := httptest.NewRequest(http.MethodGet, "/AAAAAA", nil)
+	req.Header.Set("Referer", "https://Example.com/page")
+	req.Header.Set("User-Agent", "curl/8.0")
+
+	c := newClickCounter(db, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.run(ctx, 10*time.Millisecond)
+
+	c.count("AAAAAA", req, false, "")
+	c.count("AAAAAA", req, false, "")
+	c.count("BBBBBB", req, false, "")
+	c.count("AAAAAA", req, true, "")
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual(map[string][2]int64{"AAAAAA": {2, 1}, "BBBBBB": {1, 0}}, counts())
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	day := time.Now().Unix() / 86400
+	require.Equal(t, int64(2), storedStats["AAAAAA"][fmt.Sprintf("d:%d", day)])
+	require.Equal(t, int64(2), storedStats["AAAAAA"][fmt.Sprintf("r:%d:example.com", day)])
+	require.Equal(t, int64(2), storedStats["AAAAAA"][fmt.Sprintf("u:%d:other", day)])
+	require.Equal(t, int64(2), storedStats["AAAAAA"][fmt.Sprintf("c:%d:unknown", day)])
+	require.Equal(t, int64(1), storedStats["AAAAAA"][fmt.Sprintf("b:%d", day)])
+	mu.Unlock()
+
+	// the rest of clicks are stored on stop even if storing fails
+	db.addClicksFunc = func(clicks map[string]Clicks) error {
+		mu.Lock()
+		defer mu.Unlock()
+		stored = clicks
+		return errors.New("some error")
+	}
+	c.count("CCCCCC", req, false, "")
+	cancel()
+	c.wait()
+	require.Equal(t, map[string][2]int64{"CCCCCC": {1, 0}}, counts())
+}
+
+func TestClickCounterQueueOverflow(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/AAAAAA", nil)
+	c := newClickCounter(newMockDB(), nil)
+	for range clicksQueueSize + 10 {
+		c.count("AAAAAA", req, false, "")
+	}
+	require.Len(t, c.queue, clicksQueueSize)
+
+	stored := map[string]Clicks{}
+	db := newMockDB()
+	db.addClicksFunc = func(clicks map[string]Clicks) error {
+		stored = clicks
+		return nil
+	}
+	c.tokenDB = db
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.run(ctx, time.Hour)
+	require.Equal(t, int64(clicksQueueSize), stored["AAAAAA"].Count)
+}
@@ -0,0 +1,137 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains client IP address resolving behind trusted proxies
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	// forwarding headers
+	headerXForwardedFor = "X-Forwarded-For" // de facto standard forwarding header
+	headerForwarded     = "Forwarded"       // RFC 7239 forwarding header
+)
+
+// clientIPKey is the request context key for the resolved client IP address
+type clientIPKey struct{}
+
+// trustedProxies is the list of networks of trusted proxies
+type trustedProxies []netip.Prefix
+
+// UnmarshalText parses comma separated list of trusted proxies, every item is CIDR or single IP address
+func (tp *trustedProxies) UnmarshalText(text []byte) error {
+	proxies := trustedProxies{}
+	for item := range strings.SplitSeq(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, e := netip.ParseAddr(item)
+			if e != nil {
+				return fmt.Errorf("wrong trusted proxy '%s'", item)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	*tp = proxies
+	return nil
+}
+
+// contains returns true when the address belongs to any trusted proxy network
+func (tp trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range tp {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns IP address of the request client. The peer address is the client address unless it is
+// trusted proxy. Then the addresses of the forwarding header that the trusted proxies set are checked from
+// right to left and the first address that is not trusted proxy is the client address. The hops are appended
+// by proxies, so the client can forge only the hops to the left of its own address. Any other forwarding
+// header is ignored as it can be entirely forged by the client. The last valid address is used when the next
+// one is not valid (e.g. obfuscated identifier) or when all the addresses are trusted.
+func (tp trustedProxies) resolve(r *http.Request, header string) net.IP {
+	peer := remoteIP(r)
+	addr, ok := netip.AddrFromSlice(peer)
+	if !ok || !tp.contains(addr) {
+		return peer
+	}
+	hops := forwardedFor(r.Header.Values(header))
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !tp.contains(addr) {
+			break
+		}
+	}
+	return net.IP(addr.AsSlice())
+}
+
+// forwardedFor returns the forwarded addresses of Forwarded (RFC 7239) or X-Forwarded-For header values in
+// order of hops. The ports and the brackets of IPv6 addresses are removed, the rest of values (e.g. "unknown"
+// or obfuscated identifiers) are returned as is.
+func forwardedFor(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for element := range strings.SplitSeq(value, ",") {
+			hop := strings.TrimSpace(element)
+			if strings.Contains(hop, "=") {
+				// Forwarded element: the list of name=value pairs
+				hop = ""
+				for pair := range strings.SplitSeq(element, ";") {
+					if name, v, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(name, "for") {
+						hop = strings.Trim(v, `"`)
+					}
+				}
+			}
+			if host, _, err := net.SplitHostPort(hop); err == nil {
+				hop = host
+			}
+			hops = append(hops, strings.Trim(hop, "[]"))
+		}
+	}
+	return hops
+}
+
+// withClientIP returns the request with resolved client IP address in its context
+func withClientIP(r *http.Request, ip net.IP) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// clientIP returns the resolved client IP address of the request, the peer address is returned when the
+// request was not passed through the service handler
+func clientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns IP address of the request peer
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
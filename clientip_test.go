@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardedFor(t *testing.T) {
+	require.Equal(t, []string{"192.0.2.1", "10.0.0.1", "2001:db8::1"},
+		forwardedFor([]string{"192.0.2.1, 10.0.0.1:8080", "[2001:db8::1]:443"}))
+	require.Equal(t, []string{"192.0.2.43", "2001:db8:cafe::17", "_hidden", ""},
+		forwardedFor([]string{`for=192.0.2.43;proto=https, For="[2001:db8:cafe::17]:4711"`, "for=_hidden, by=10.0.0.1"}))
+	require.Empty(t, forwardedFor(nil))
+}
+
+func TestClientIP(t *testing.T) {
+	var proxies trustedProxies
+	require.NoError(t, proxies.UnmarshalText([]byte("10.0.0.0/8, 2001:db8:1::/48")))
+	header := headerXForwardedFor
+	resolve := func(remoteAddr string, headers ...string) string {
+		r := httptest.NewRequest("GET", "/AAAAAA", nil)
+		r.RemoteAddr = remoteAddr
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Add(headers[i], headers[i+1])
+		}
+		return proxies.resolve(r, header).String()
+	}
+	// not trusted peer: headers are ignored
+	require.Equal(t, "192.0.2.1", resolve("192.0.2.1:1234", "X-Forwarded-For", "198.51.100.1"))
+	// trusted proxies are skipped from right to left, forged left hops are ignored
+	require.Equal(t, "198.51.100.1", resolve("10.0.0.1:1234", "X-Forwarded-For", "203.0.113.9, 198.51.100.1, 10.0.0.2"))
+	require.Equal(t, "198.51.100.1", resolve("[2001:db8:1::1]:1234", "X-Forwarded-For", "203.0.113.9", "X-Forwarded-For", "198.51.100.1"))
+	// all hops are trusted: the last valid address is used
+	require.Equal(t, "10.0.0.3", resolve("10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 10.0.0.2"))
+	require.Equal(t, "10.0.0.1", resolve("10.0.0.1:1234"))
+	require.Equal(t, "<nil>", resolve("wrong"))
+	// the header that the proxies don't set is ignored even when it is the only one
+	require.Equal(t, "198.51.100.1", resolve("10.0.0.1:1234", "Forwarded", "for=203.0.113.9", "X-Forwarded-For", "198.51.100.1"))
+	require.Equal(t, "10.0.0.1", resolve("10.0.0.1:1234", "Forwarded", "for=203.0.113.9"))
+
+	header = headerForwarded
+	require.Equal(t, "2001:db8::1", resolve("10.0.0.1:1234", "Forwarded", `for="[2001:db8::1]:4711", for=10.0.0.2`, "X-Forwarded-For", "198.51.100.1"))
+	require.Equal(t, "10.0.0.1", resolve("10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1"))
+	// the next hop is not valid: the last valid address is used
+	require.Equal(t, "10.0.0.2", resolve("10.0.0.1:1234", "Forwarded", "for=unknown, for=10.0.0.2"))
+
+	r := httptest.NewRequest("GET", "/AAAAAA", nil)
+	require.Equal(t, net.ParseIP("192.0.2.1"), clientIP(r))
+	require.Equal(t, net.ParseIP("198.51.100.1"), clientIP(withClientIP(r, net.ParseIP("198.51.100.1"))))
+}
+
+func TestRemoteIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/AAAAAA", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	require.Equal(t, "192.0.2.1", remoteIP(req).String())
+	req.RemoteAddr = "[2001:db8::1]:1234"
+	require.Equal(t, "2001:db8::1", remoteIP(req).String())
+	req.RemoteAddr = "wrong"
+	require.Nil(t, remoteIP(req))
+}
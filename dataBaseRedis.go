@@ -8,8 +8,12 @@ package main
 // This file contains database interface
 
 import (
+	"context"
 	"errors"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -17,16 +21,229 @@ import (
 
 // TokenDB is the interface to token database
 type TokenDB interface {
-	Set(sToken, longURL string, expiration int) (bool, error) // store token and long URL and set the expiration in days
-	Get(sToken string) (string, error)                        // find the long URL for given token
-	Expire(sToken string, expiration int) error               // change the given token expiration in days
-	Delete(sToken string) error                               // delete given token - for tests only
-	Close() error                                             // close the database connection
+	Set(sToken, longURL string, expiration int) (bool, error)     // store token and long URL and set the expiration in days
+	Get(sToken string) (string, error)                            // find the long URL for given token
+	Expire(sToken string, expiration int) error                   // change the given token expiration in days
+	Update(sToken, longURL string) error                          // change the long URL of given token keeping its expiration
+	Delete(sToken string) error                                   // delete given token
+	Use(sToken string, maxClicks int, spend bool) (bool, error)   // consume (or check when !spend) one of maxClicks clicks of given token, false when all are used
+	SetFallback(sToken, fallbackURL string, expiration int) error // store tombstone of given token with fallback URL and set its expiration in days
+	GetFallback(sToken string) (string, error)                    // find the fallback URL in tombstone of given token
+	GetCreated(sToken string) (time.Time, error)                  // find the creation time of given token
+	AddFailure(sToken string, window time.Duration) (int, error)  // count password attempt of given token for window, return the number of attempts
+	CancelFailure(sToken string) error                            // uncount the password attempt of given token that was right
+	AddClicks(clicks map[string]Clicks) error                     // add clicks statistics of existing tokens
+	GetClicks(sToken string) (Clicks, error)                      // get clicks statistics of given token
+	AddStats(stats map[string]ClickStats) error                   // add time bucketed clicks statistics of existing tokens
+	GetStats(sToken string) (ClickStats, error)                   // get time bucketed clicks statistics of given token
+	WatchExpired(ctx context.Context, expired func(string)) error // call expired for every token expired by TTL until ctx is done
+	ClaimExpired(sToken string) (bool, error)                     // claim the token expired by TTL, only the first claim is successful
+	SweepExpired(limit int) ([]string, error)                     // claim up to limit tokens expired by TTL that are not claimed yet
+	Close() error                                                 // close the database connection
 }
 
+// Clicks is the clicks statistics of token
+type Clicks struct {
+	Count     int64     `json:"count"`               // number of redirects (bot hits are not included)
+	Bots      int64     `json:"bots"`                // number of redirects made by bots and crawlers
+	FirstSeen time.Time `json:"first_seen,omitzero"` // time of the first redirect
+	LastSeen  time.Time `json:"last_seen,omitzero"`  // time of the last redirect
+}
+
+const (
+	// addClicksScript adds clicks to the statistics of existing token and sets the same TTL for statistics as the token has.
+	// KEYS[1] - token, KEYS[2] - token statistics,
+	// ARGV[1] - count, ARGV[2] - first seen, ARGV[3] - last seen (unix ms), ARGV[4] - bots count
+	addClicksScript = `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call('HINCRBY', KEYS[2], 'count', ARGV[1])
+	redis.call('HSETNX', KEYS[2], 'first', ARGV[2])
+	local last = tonumber(redis.call('HGET', KEYS[2], 'last') or '0')
+	if tonumber(ARGV[3]) > last then
+		redis.call('HSET', KEYS[2], 'last', ARGV[3])
+	end
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call('HINCRBY', KEYS[2], 'bots', ARGV[4])
+end
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+else
+	redis.call('PERSIST', KEYS[2])
+end
+return 1`
+
+	// addStatsScript adds counters to the statistics of existing token and sets the same TTL for statistics as the token has.
+	// The new referrer hosts of the day are counted in "n:<day>" field, the clicks from hosts above the limit are added to
+	// "other" referrer. The hourly counters older than the oldest hour to keep are removed when the new hour is started.
+	// KEYS[1] - token, KEYS[2] - token statistics,
+	// ARGV[1] - oldest hour to keep, ARGV[2] - maximum number of referrer hosts per day, the rest of ARGV - pairs of field and increment
+	addStatsScript = `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+end
+local newHour = false
+for i = 3, #ARGV, 2 do
+	local field = ARGV[i]
+	local day = string.match(field, '^r:(%d+):')
+	if day and redis.call('HEXISTS', KEYS[2], field) == 0 then
+		if tonumber(redis.call('HGET', KEYS[2], 'n:' .. day) or '0') < tonumber(ARGV[2]) then
+			redis.call('HINCRBY', KEYS[2], 'n:' .. day, 1)
+		else
+			field = 'r:' .. day .. ':other'
+		end
+	end
+	if redis.call('HINCRBY', KEYS[2], field, ARGV[i+1]) == tonumber(ARGV[i+1]) and string.sub(field, 1, 2) == 'h:' then
+		newHour = true
+	end
+end
+if newHour then
+	for _, field in ipairs(redis.call('HKEYS', KEYS[2])) do
+		local hour = string.match(field, '^h:(%d+)$')
+		if hour and tonumber(hour) < tonumber(ARGV[1]) then
+			redis.call('HDEL', KEYS[2], field)
+		end
+	end
+end
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+else
+	redis.call('PERSIST', KEYS[2])
+end
+return 1`
+
+	// setScript stores the new token with its creation time (with the same TTL) and removes the tombstone left by the
+	// previous token with the same name, so the new token doesn't inherit its fallback URL. The creation time is stored
+	// separately as the token value stays plain long URL for the links without options.
+	// KEYS[1] - token, KEYS[2] - token tombstone, KEYS[3] - token creation time,
+	// ARGV[1] - long URL, ARGV[2] - expiration in ms (0 for persistent token), ARGV[3] - creation time (unix seconds)
+	setScript = `
+local ok
+if tonumber(ARGV[2]) > 0 then
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX')
+	if ok then
+		redis.call('SET', KEYS[3], ARGV[3], 'PX', ARGV[2])
+	end
+else
+	ok = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+	if ok then
+		redis.call('SET', KEYS[3], ARGV[3])
+	end
+end
+if not ok then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+return 1`
+
+	// updateScript replaces the value of existing token keeping its TTL (as SET ... XX KEEPTTL but for Redis < 6).
+	// KEYS[1] - token, ARGV[1] - long URL
+	updateScript = `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1`
+
+	// useScript consumes one click of existing click limited token and sets the same TTL for the remaining clicks
+	// counter as the token has. The counter is initialized by the first click. The click is only checked when it is
+	// not spent.
+	// KEYS[1] - token, KEYS[2] - remaining clicks counter, ARGV[1] - maximum number of clicks, ARGV[2] - 1 to spend the click
+	useScript = `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+end
+local left = tonumber(redis.call('GET', KEYS[2]) or ARGV[1])
+if left <= 0 then
+	return 0
+end
+if ARGV[2] ~= '1' then
+	return 1
+end
+redis.call('SET', KEYS[2], left - 1)
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return 1`
+
+	// addFailureScript counts password attempt and returns the number of attempts in the window, the counter expires
+	// in the window after the first attempt. The attempt is counted before the password check, so the parallel attempts
+	// can't exceed the limit.
+	// KEYS[1] - wrong attempts counter, ARGV[1] - window in ms
+	addFailureScript = `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n`
+
+	// cancelFailureScript uncounts the password attempt when the counter still exists (the window is not over).
+	// KEYS[1] - wrong attempts counter
+	cancelFailureScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+return redis.call('DECR', KEYS[1])`
+
+	// expiredChannel is the keyspace notifications channel pattern of expired keys
+	expiredChannel = "__keyevent@*__:expired"
+
+	// expiringKey is the key of the sorted set of tokens with expiration scored by the expiration time (unix ms),
+	// the tokens never have ':' in their names
+	expiringKey = "urlshortener:expiring"
+)
+
 // tokenDBR is a structure to handle the DB token operations via Redis database
 type tokenDBR struct {
-	db redis.UniversalClient
+	db         redis.UniversalClient
+	set        *redis.Script
+	addClicks  *redis.Script
+	addStats   *redis.Script
+	update     *redis.Script
+	use        *redis.Script
+	addFailure *redis.Script
+	cancelFail *redis.Script
+}
+
+// clicksKey returns the key of token clicks statistics.
+// The token is used as hash tag to keep the statistics in the same cluster slot as the token.
+func clicksKey(sToken string) string {
+	return "clicks:{" + sToken + "}"
+}
+
+// statsKey returns the key of token time bucketed clicks statistics (in the same cluster slot as the token)
+func statsKey(sToken string) string {
+	return "stats:{" + sToken + "}"
+}
+
+// leftKey returns the key of token remaining clicks counter (in the same cluster slot as the token)
+func leftKey(sToken string) string {
+	return "left:{" + sToken + "}"
+}
+
+// fallbackKey returns the key of token tombstone with fallback URL (in the same cluster slot as the token)
+func fallbackKey(sToken string) string {
+	return "fallback:{" + sToken + "}"
+}
+
+// createdKey returns the key of token creation time (in the same cluster slot as the token)
+func createdKey(sToken string) string {
+	return "created:{" + sToken + "}"
+}
+
+// failuresKey returns the key of token wrong password attempts counter (in the same cluster slot as the token)
+func failuresKey(sToken string) string {
+	return "failures:{" + sToken + "}"
 }
 
 // NewTokenDB creates new database interface to Redis database
@@ -43,7 +260,8 @@ func NewTokenDB(addrs []string, password string) (TokenDB, error) {
 		return nil, err
 	}
 
-	return &tokenDBR{db}, nil
+	return &tokenDBR{db, redis.NewScript(setScript), redis.NewScript(addClicksScript), redis.NewScript(addStatsScript), redis.NewScript(updateScript), redis.NewScript(useScript),
+		redis.NewScript(addFailureScript), redis.NewScript(cancelFailureScript)}, nil
 }
 
 // New creates new token for given long URL
@@ -52,7 +270,23 @@ func (t *tokenDBR) Set(sToken, longURL string, expiration int) (bool, error) {
 		expiration = 0
 	}
 	// try to store token
-	return t.db.SetNX(sToken, longURL, time.Hour*24*time.Duration(expiration)).Result()
+	set, err := t.set.Run(t.db, []string{sToken, fallbackKey(sToken), createdKey(sToken)}, longURL,
+		(time.Hour * 24 * time.Duration(expiration)).Milliseconds(), time.Now().Unix()).Int()
+	ok := set == 1
+	if ok && err == nil {
+		err = t.setExpiring(sToken, expiration)
+	}
+	return ok, err
+}
+
+// setExpiring stores the token expiration time for expired tokens sweeping
+func (t *tokenDBR) setExpiring(sToken string, expiration int) error {
+	if expiration <= 0 {
+		// the token is persistent or it is already removed (not expired)
+		return t.db.ZRem(expiringKey, sToken).Err()
+	}
+	expireAt := time.Now().Add(time.Hour * 24 * time.Duration(expiration)).UnixMilli()
+	return t.db.ZAdd(expiringKey, &redis.Z{Score: float64(expireAt), Member: sToken}).Err()
 }
 
 // Get returns the long URL for given token
@@ -73,6 +307,26 @@ func (t *tokenDBR) Expire(sToken string, expiration int) error {
 	if err == nil && !ok {
 		return errors.New("token is not exists")
 	}
+	if err == nil {
+		// statistics, remaining clicks counter and creation time live as long as the token
+		for _, key := range []string{clicksKey(sToken), statsKey(sToken), leftKey(sToken), createdKey(sToken)} {
+			if err = t.db.Expire(key, time.Hour*24*time.Duration(expiration)).Err(); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = t.setExpiring(sToken, expiration)
+	}
+	return err
+}
+
+// Update changes the long URL of token keeping the token expiration
+func (t *tokenDBR) Update(sToken, longURL string) error {
+	updated, err := t.update.Run(t.db, []string{sToken}, longURL).Int()
+	if err == nil && updated == 0 {
+		return errors.New("token is not exists")
+	}
 	return err
 }
 
@@ -84,9 +338,234 @@ func (t *tokenDBR) Delete(sToken string) error {
 	if err == nil && deleted == 0 {
 		return errors.New("token is not exists")
 	}
+	if err == nil {
+		// delete the token statistics, remaining clicks counter, tombstone, wrong password attempts counter and creation time too
+		err = t.db.Del(clicksKey(sToken), statsKey(sToken), leftKey(sToken), fallbackKey(sToken), failuresKey(sToken),
+			createdKey(sToken)).Err()
+	}
+	if err == nil {
+		err = t.db.ZRem(expiringKey, sToken).Err()
+	}
 	return err
 }
 
+// Use consumes one click of token limited by maxClicks clicks (or only checks that the click is left when it is not
+// spent), it returns false when all the clicks are already used (or the token is not exists)
+func (t *tokenDBR) Use(sToken string, maxClicks int, spend bool) (bool, error) {
+	flag := 0
+	if spend {
+		flag = 1
+	}
+	used, err := t.use.Run(t.db, []string{sToken, leftKey(sToken)}, maxClicks, flag).Int()
+	return used == 1, err
+}
+
+// SetFallback stores the tombstone of token with fallback URL, the tombstone outlives the token
+// as its expiration is not changed with the token expiration
+func (t *tokenDBR) SetFallback(sToken, fallbackURL string, expiration int) error {
+	if expiration < 0 {
+		expiration = 0
+	}
+	return t.db.Set(fallbackKey(sToken), fallbackURL, time.Hour*24*time.Duration(expiration)).Err()
+}
+
+// GetFallback returns the fallback URL from tombstone of token
+func (t *tokenDBR) GetFallback(sToken string) (string, error) {
+	return t.db.Get(fallbackKey(sToken)).Result()
+}
+
+// GetCreated returns the creation time of token
+func (t *tokenDBR) GetCreated(sToken string) (time.Time, error) {
+	created, err := t.db.Get(createdKey(sToken)).Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(created, 0).UTC(), nil
+}
+
+// AddFailure counts password attempt of token and returns the number of attempts made in the current window,
+// the window starts by the first attempt
+func (t *tokenDBR) AddFailure(sToken string, window time.Duration) (int, error) {
+	n, err := t.addFailure.Run(t.db, []string{failuresKey(sToken)}, window.Milliseconds()).Int()
+	return n, err
+}
+
+// CancelFailure uncounts the password attempt of token that turned out to be right
+func (t *tokenDBR) CancelFailure(sToken string) error {
+	return t.cancelFail.Run(t.db, []string{failuresKey(sToken)}).Err()
+}
+
+// AddClicks adds clicks statistics of tokens, statistics of not existing tokens are ignored
+func (t *tokenDBR) AddClicks(clicks map[string]Clicks) error {
+	for sToken, c := range clicks {
+		err := t.addClicks.Run(t.db, []string{sToken, clicksKey(sToken)},
+			c.Count, c.FirstSeen.UnixMilli(), c.LastSeen.UnixMilli(), c.Bots).Err()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetClicks returns clicks statistics of token
+func (t *tokenDBR) GetClicks(sToken string) (Clicks, error) {
+	values, err := t.db.HGetAll(clicksKey(sToken)).Result()
+	if err != nil {
+		return Clicks{}, err
+	}
+	clicks := Clicks{}
+	clicks.Count, _ = strconv.ParseInt(values["count"], 10, 64)
+	clicks.Bots, _ = strconv.ParseInt(values["bots"], 10, 64)
+	if ms, err := strconv.ParseInt(values["first"], 10, 64); err == nil {
+		clicks.FirstSeen = time.UnixMilli(ms)
+	}
+	if ms, err := strconv.ParseInt(values["last"], 10, 64); err == nil {
+		clicks.LastSeen = time.UnixMilli(ms)
+	}
+	return clicks, nil
+}
+
+// AddStats adds time bucketed clicks statistics of tokens, statistics of not existing tokens are ignored.
+// The hourly statistics are kept for statsHourlyRetention days, the number of referrer hosts per day is limited
+// by statsMaxReferrers.
+func (t *tokenDBR) AddStats(stats map[string]ClickStats) error {
+	oldestHour := time.Now().Add(-statsHourlyRetention).Unix() / 3600
+	for sToken, s := range stats {
+		if len(s) == 0 {
+			continue
+		}
+		args := make([]interface{}, 0, 2*len(s)+2)
+		args = append(args, oldestHour, statsMaxReferrers)
+		for field, count := range s {
+			args = append(args, field, count)
+		}
+		err := t.addStats.Run(t.db, []string{sToken, statsKey(sToken)}, args...).Err()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStats returns time bucketed clicks statistics of token
+func (t *tokenDBR) GetStats(sToken string) (ClickStats, error) {
+	values, err := t.db.HGetAll(statsKey(sToken)).Result()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(ClickStats, len(values))
+	for field, value := range values {
+		stats[field], _ = strconv.ParseInt(value, 10, 64)
+	}
+	return stats, nil
+}
+
+// WatchExpired calls expired for every token expired by TTL until ctx is done. It uses Redis keyspace notifications
+// and tries to enable them for expired keys when they are disabled.
+func (t *tokenDBR) WatchExpired(ctx context.Context, expired func(string)) error {
+	cluster, ok := t.db.(*redis.ClusterClient)
+	if !ok {
+		return watchExpired(ctx, t.db, expired)
+	}
+	// keyspace notifications are not broadcasted in cluster: every master node has to be watched
+	errs := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	err := cluster.ForEachMaster(func(node *redis.Client) error {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := watchExpired(ctx, node, expired); err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	if err == nil && len(errs) > 0 {
+		err = <-errs
+	}
+	return err
+}
+
+// watchExpired watches expired keys of single Redis node
+func watchExpired(ctx context.Context, db redis.UniversalClient, expired func(string)) error {
+	// notifications are needed for keyevent (E) of expired (x) keys
+	if values, err := db.ConfigGet("notify-keyspace-events").Result(); err != nil || len(values) != 2 {
+		log.Printf("keyspace notifications configuration can't be checked (%v): make sure that notify-keyspace-events contains 'Ex'", err)
+	} else if flags, _ := values[1].(string); !strings.Contains(flags, "E") || !strings.ContainsAny(flags, "xA") {
+		if err := db.ConfigSet("notify-keyspace-events", flags+"Ex").Err(); err != nil {
+			log.Printf("keyspace notifications can't be enabled (%v): set notify-keyspace-events to 'Ex' in Redis configuration", err)
+		}
+	}
+
+	pubSub := db.PSubscribe(expiredChannel)
+	defer pubSub.Close()
+	if _, err := pubSub.Receive(); err != nil {
+		return err
+	}
+	messages := pubSub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			// statistics keys have ':' in their names but tokens never have
+			if !strings.Contains(m.Payload, ":") {
+				expired(m.Payload)
+			}
+		}
+	}
+}
+
+// ClaimExpired claims the token expired by TTL, it returns true only for the first claim, so the expiration
+// is handled once by all the service instances (both by keyspace notifications and by sweeping)
+func (t *tokenDBR) ClaimExpired(sToken string) (bool, error) {
+	removed, err := t.db.ZRem(expiringKey, sToken).Result()
+	return removed == 1, err
+}
+
+// SweepExpired claims up to limit tokens which expiration time is over and which are already removed by TTL.
+// It finds the expired tokens when keyspace notifications are not available or when the tokens expired while
+// no service instance was running.
+func (t *tokenDBR) SweepExpired(limit int) ([]string, error) {
+	tokens, err := t.db.ZRangeByScore(expiringKey, &redis.ZRangeBy{
+		Min: "-inf", Max: strconv.FormatInt(time.Now().UnixMilli(), 10), Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	expired := []string{}
+	for _, sToken := range tokens {
+		ttl, err := t.db.PTTL(sToken).Result()
+		if err != nil {
+			return expired, err
+		}
+		switch {
+		case ttl > 0:
+			// the token expiration was changed bypassing the service: correct the expiration time
+			err = t.db.ZAdd(expiringKey, &redis.Z{Score: float64(time.Now().Add(ttl).UnixMilli()), Member: sToken}).Err()
+		case ttl == -1:
+			// the token was made persistent bypassing the service
+			err = t.db.ZRem(expiringKey, sToken).Err()
+		default:
+			var claimed bool
+			if claimed, err = t.ClaimExpired(sToken); claimed {
+				expired = append(expired, sToken)
+			}
+		}
+		if err != nil {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
 // Close - flush data and close connection to database
 func (t *tokenDBR) Close() error {
 	_, err := t.db.BgSave().Result()
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -17,11 +20,25 @@ import (
 var testDBToken string = "AAAA"
 
 type mockDB struct {
-	setFunc   func(string, string, int) (bool, error)
-	getFunc   func(string) (string, error)
-	expFunc   func(string, int) error
-	delFunc   func(string) error
-	closeFunc func() error
+	setFunc       func(string, string, int) (bool, error)
+	getFunc       func(string) (string, error)
+	expFunc       func(string, int) error
+	delFunc       func(string) error
+	updateFunc    func(string, string) error
+	useFunc       func(string, int, bool) (bool, error)
+	setFbFunc     func(string, string, int) error
+	getFbFunc     func(string) (string, error)
+	createdFunc   func(string) (time.Time, error)
+	addFailFunc   func(string, time.Duration) (int, error)
+	cancelFnFunc  func(string) error
+	addClicksFunc func(map[string]Clicks) error
+	getClicksFunc func(string) (Clicks, error)
+	addStatsFunc  func(map[string]ClickStats) error
+	getStatsFunc  func(string) (ClickStats, error)
+	watchFunc     func(context.Context, func(string)) error
+	claimFunc     func(string) (bool, error)
+	sweepFunc     func(int) ([]string, error)
+	closeFunc     func() error
 }
 
 func (m *mockDB) Set(sToken, longURL string, expiration int) (bool, error) {
@@ -36,21 +53,91 @@ func (m *mockDB) Expire(sToken string, expiration int) error {
 	return m.expFunc(sToken, expiration)
 }
 
+func (m *mockDB) Update(sToken, longURL string) error {
+	return m.updateFunc(sToken, longURL)
+}
+
 func (m *mockDB) Delete(sToken string) error {
 	return m.delFunc(sToken)
 }
 
+func (m *mockDB) Use(sToken string, maxClicks int, spend bool) (bool, error) {
+	return m.useFunc(sToken, maxClicks, spend)
+}
+
+func (m *mockDB) SetFallback(sToken, fallbackURL string, expiration int) error {
+	return m.setFbFunc(sToken, fallbackURL, expiration)
+}
+
+func (m *mockDB) GetFallback(sToken string) (string, error) {
+	return m.getFbFunc(sToken)
+}
+
+func (m *mockDB) GetCreated(sToken string) (time.Time, error) {
+	return m.createdFunc(sToken)
+}
+
+func (m *mockDB) AddFailure(sToken string, window time.Duration) (int, error) {
+	return m.addFailFunc(sToken, window)
+}
+
+func (m *mockDB) CancelFailure(sToken string) error {
+	return m.cancelFnFunc(sToken)
+}
+
+func (m *mockDB) AddClicks(clicks map[string]Clicks) error {
+	return m.addClicksFunc(clicks)
+}
+
+func (m *mockDB) GetClicks(sToken string) (Clicks, error) {
+	return m.getClicksFunc(sToken)
+}
+
+func (m *mockDB) AddStats(stats map[string]ClickStats) error {
+	return m.addStatsFunc(stats)
+}
+
+func (m *mockDB) GetStats(sToken string) (ClickStats, error) {
+	return m.getStatsFunc(sToken)
+}
+
+func (m *mockDB) WatchExpired(ctx context.Context, expired func(string)) error {
+	return m.watchFunc(ctx, expired)
+}
+
+func (m *mockDB) ClaimExpired(sToken string) (bool, error) {
+	return m.claimFunc(sToken)
+}
+
+func (m *mockDB) SweepExpired(limit int) ([]string, error) {
+	return m.sweepFunc(limit)
+}
+
 func (m *mockDB) Close() error {
 	return m.closeFunc()
 }
 
 func newMockDB() *mockDB {
 	return &mockDB{
-		setFunc:   func(_, _ string, _ int) (bool, error) { return true, nil },
-		getFunc:   func(_ string) (string, error) { return "http://localhost:8080/favicon.ico", nil },
-		expFunc:   func(_ string, _ int) error { return nil },
-		delFunc:   func(_ string) error { return nil },
-		closeFunc: func() error { return nil },
+		setFunc:       func(_, _ string, _ int) (bool, error) { return true, nil },
+		getFunc:       func(_ string) (string, error) { return "http://localhost:8080/favicon.ico", nil },
+		expFunc:       func(_ string, _ int) error { return nil },
+		delFunc:       func(_ string) error { return nil },
+		updateFunc:    func(_, _ string) error { return nil },
+		useFunc:       func(_ string, _ int, _ bool) (bool, error) { return true, nil },
+		setFbFunc:     func(_, _ string, _ int) error { return nil },
+		getFbFunc:     func(_ string) (string, error) { return "", redis.Nil },
+		createdFunc:   func(_ string) (time.Time, error) { return time.Time{}, redis.Nil },
+		addFailFunc:   func(_ string, _ time.Duration) (int, error) { return 1, nil },
+		cancelFnFunc:  func(_ string) error { return nil },
+		addClicksFunc: func(_ map[string]Clicks) error { return nil },
+		getClicksFunc: func(_ string) (Clicks, error) { return Clicks{}, nil },
+		addStatsFunc:  func(_ map[string]ClickStats) error { return nil },
+		getStatsFunc:  func(_ string) (ClickStats, error) { return ClickStats{}, nil },
+		watchFunc:     func(ctx context.Context, _ func(string)) error { <-ctx.Done(); return nil },
+		claimFunc:     func(_ string) (bool, error) { return true, nil },
+		sweepFunc:     func(_ int) ([]string, error) { return nil, nil },
+		closeFunc:     func() error { return nil },
 	}
 }
 
@@ -149,17 +236,213 @@ func Test05DBR10All(t *testing.T) {
 		require.NoError(t, err)
 		require.NotEmpty(t, lURL)
 	})
+	t.Run("update: success", func(t *testing.T) {
+		db := testDB.(*tokenDBR).db
+		require.NoError(t, db.Expire(testDBToken, time.Hour).Err())
+
+		require.NoError(t, testDB.Update(testDBToken, "https://golang.org/pkg/time/other"))
+
+		lURL, err := testDB.Get(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, "https://golang.org/pkg/time/other", lURL)
+		// expiration is kept
+		ttl, err := db.TTL(testDBToken).Result()
+		require.NoError(t, err)
+		require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+	})
+	t.Run("clicks: success", func(t *testing.T) {
+		first := time.UnixMilli(time.Now().UnixMilli())
+		last := first.Add(time.Minute)
+		require.NoError(t, testDB.AddClicks(map[string]Clicks{
+			testDBToken:       {Count: 2, FirstSeen: first, LastSeen: first, Bots: 1},
+			testDBToken + "$": {Count: 1, FirstSeen: first, LastSeen: first}, // not existing token
+		}))
+		require.NoError(t, testDB.AddClicks(map[string]Clicks{testDBToken: {Count: 3, FirstSeen: last, LastSeen: last}}))
+
+		clicks, err := testDB.GetClicks(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, Clicks{Count: 5, FirstSeen: first, LastSeen: last, Bots: 1}, clicks)
+
+		// bot hits only
+		require.NoError(t, testDB.AddClicks(map[string]Clicks{testDBToken: {Bots: 2}}))
+		clicks, err = testDB.GetClicks(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, Clicks{Count: 5, FirstSeen: first, LastSeen: last, Bots: 3}, clicks)
+
+		clicks, err = testDB.GetClicks(testDBToken + "$")
+		require.NoError(t, err)
+		require.Equal(t, Clicks{}, clicks)
+	})
+	t.Run("stats: success", func(t *testing.T) {
+		hour := time.Now().Unix() / 3600
+		h := func(hour int64) string { return "h:" + strconv.FormatInt(hour, 10) }
+		oldHour := hour - int64(statsHourlyRetention/time.Hour) - 1
+		require.NoError(t, testDB.AddStats(map[string]ClickStats{
+			testDBToken:       {h(oldHour): 1, h(hour - 1): 2, "d:1": 2},
+			testDBToken + "$": {h(hour): 1}, // not existing token
+		}))
+		require.NoError(t, testDB.AddStats(map[string]ClickStats{testDBToken: {h(hour - 1): 1, "r:1:direct": 1}}))
+
+		stats, err := testDB.GetStats(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, ClickStats{h(hour - 1): 3, "d:1": 2, "r:1:direct": 1, "n:1": 1}, stats)
+
+		// the hourly statistics older than retention period are removed when the new hour is started
+		require.NoError(t, testDB.AddStats(map[string]ClickStats{testDBToken: {h(oldHour - 1): 1}}))
+		require.NoError(t, testDB.AddStats(map[string]ClickStats{testDBToken: {h(hour): 1}}))
+		stats, err = testDB.GetStats(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, ClickStats{h(hour - 1): 3, h(hour): 1, "d:1": 2, "r:1:direct": 1, "n:1": 1}, stats)
+
+		// the number of referrer hosts per day is limited
+		referrers := ClickStats{}
+		for i := range statsMaxReferrers + 5 {
+			referrers[fmt.Sprintf("r:2:host%d.example", i)] = 1
+		}
+		require.NoError(t, testDB.AddStats(map[string]ClickStats{testDBToken: referrers}))
+		require.NoError(t, testDB.AddStats(map[string]ClickStats{testDBToken: {"r:2:new.example": 2}}))
+		stats, err = testDB.GetStats(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, int64(statsMaxReferrers), stats["n:2"])
+		require.Equal(t, int64(5+2), stats["r:2:other"])
+		require.NotContains(t, stats, "r:2:new.example")
+		hosts := 0
+		for field := range stats {
+			if strings.HasPrefix(field, "r:2:host") {
+				hosts++
+			}
+		}
+		require.Equal(t, statsMaxReferrers, hosts)
+
+		stats, err = testDB.GetStats(testDBToken + "$")
+		require.NoError(t, err)
+		require.Empty(t, stats)
+	})
+	t.Run("use: success", func(t *testing.T) {
+		for range 2 {
+			// the check doesn't spend the click
+			ok, err := testDB.Use(testDBToken, 2, false)
+			require.NoError(t, err)
+			require.True(t, ok)
+			ok, err = testDB.Use(testDBToken, 2, true)
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+		ok, err := testDB.Use(testDBToken, 2, true)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = testDB.Use(testDBToken, 2, false)
+		require.NoError(t, err)
+		require.False(t, ok)
+		// counter lives as long as the token
+		ttl, err := testDB.(*tokenDBR).db.TTL(leftKey(testDBToken)).Result()
+		require.NoError(t, err)
+		require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+
+		ok, err = testDB.Use(testDBToken+"$", 2, true)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+	t.Run("fallback: success", func(t *testing.T) {
+		require.NoError(t, testDB.SetFallback(testDBToken, "https://golang.org/fallback", 2))
+		fallback, err := testDB.GetFallback(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, "https://golang.org/fallback", fallback)
+		// tombstone expiration doesn't depend on the token expiration
+		require.NoError(t, testDB.Expire(testDBToken, 1))
+		ttl, err := testDB.(*tokenDBR).db.TTL(fallbackKey(testDBToken)).Result()
+		require.NoError(t, err)
+		require.InDelta(t, 48*time.Hour, ttl, float64(time.Minute))
+
+		_, err = testDB.GetFallback(testDBToken + "$")
+		require.Equal(t, redis.Nil, err)
+	})
+	t.Run("created: success", func(t *testing.T) {
+		created, err := testDB.GetCreated(testDBToken)
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), created, time.Minute)
+		// creation time lives as long as the token
+		ttl, err := testDB.(*tokenDBR).db.TTL(createdKey(testDBToken)).Result()
+		require.NoError(t, err)
+		require.InDelta(t, time.Hour*24, ttl, float64(time.Minute))
+
+		_, err = testDB.GetCreated(testDBToken + "$")
+		require.Equal(t, redis.Nil, err)
+	})
+	t.Run("fallback: token reuse", func(t *testing.T) {
+		sToken := testDBToken + "R"
+		// the tombstone of previous token is removed when the token is issued again
+		require.NoError(t, testDB.SetFallback(sToken, "https://golang.org/fallback", 2))
+		ok, err := testDB.Set(sToken, "https://golang.org/new", 1)
+		require.NoError(t, err)
+		require.True(t, ok)
+		defer testDB.Delete(sToken)
+		_, err = testDB.GetFallback(sToken)
+		require.Equal(t, redis.Nil, err)
+		ttl, err := testDB.(*tokenDBR).db.TTL(sToken).Result()
+		require.NoError(t, err)
+		require.InDelta(t, 24*time.Hour, ttl, float64(time.Minute))
+
+		// but not when the token is already in use
+		require.NoError(t, testDB.SetFallback(sToken, "https://golang.org/fallback", 2))
+		ok, err = testDB.Set(sToken, "https://golang.org/other", 1)
+		require.NoError(t, err)
+		require.False(t, ok)
+		fallback, err := testDB.GetFallback(sToken)
+		require.NoError(t, err)
+		require.Equal(t, "https://golang.org/fallback", fallback)
+		longURL, err := testDB.Get(sToken)
+		require.NoError(t, err)
+		require.Equal(t, "https://golang.org/new", longURL)
+	})
+	t.Run("password failures: success", func(t *testing.T) {
+		// nothing to cancel before the first attempt
+		require.NoError(t, testDB.CancelFailure(testDBToken))
+		exists, err := testDB.(*tokenDBR).db.Exists(failuresKey(testDBToken)).Result()
+		require.NoError(t, err)
+		require.Zero(t, exists)
+		failures, err := testDB.AddFailure(testDBToken, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 1, failures)
+		failures, err = testDB.AddFailure(testDBToken, time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, 2, failures)
+		require.NoError(t, testDB.CancelFailure(testDBToken))
+		failures, err = testDB.AddFailure(testDBToken, time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, 2, failures)
+		// the window is started by the first failure
+		ttl, err := testDB.(*tokenDBR).db.TTL(failuresKey(testDBToken)).Result()
+		require.NoError(t, err)
+		require.InDelta(t, time.Minute, ttl, float64(time.Second))
+	})
 	t.Run("del: success", func(t *testing.T) {
 
 		require.NoError(t, testDB.Delete(testDBToken))
 
 		_, err := testDB.Get(testDBToken)
 		require.Error(t, err)
+
+		clicks, err := testDB.GetClicks(testDBToken)
+		require.NoError(t, err)
+		require.Equal(t, Clicks{}, clicks)
+
+		stats, err := testDB.GetStats(testDBToken)
+		require.NoError(t, err)
+		require.Empty(t, stats)
+
+		exists, err := testDB.(*tokenDBR).db.Exists(leftKey(testDBToken), fallbackKey(testDBToken), failuresKey(testDBToken),
+			createdKey(testDBToken)).Result()
+		require.NoError(t, err)
+		require.Zero(t, exists)
 	})
 
 	t.Run("expire non existing token", func(t *testing.T) {
 		require.Error(t, testDB.Expire(testDBToken+"$", -1))
 	})
+	t.Run("update non existing token", func(t *testing.T) {
+		require.Error(t, testDB.Update(testDBToken+"$", "https://golang.org"))
+	})
 	t.Run("delete non existing token", func(t *testing.T) {
 		require.Error(t, testDB.Delete(testDBToken+"$"))
 	})
@@ -173,6 +456,110 @@ func Test05DBR10All(t *testing.T) {
 	})
 }
 
+// test expired tokens watching
+func Test05DBR20WatchExpired(t *testing.T) {
+	envSet(t)
+
+	testDBConfig, err := readConfig()
+	require.NoError(t, err)
+
+	testDB, err := NewTokenDB(testDBConfig.RedisAddrs, testDBConfig.RedisPassword)
+	require.NoError(t, err)
+	defer testDB.Close()
+
+	expired := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- testDB.WatchExpired(ctx, func(sToken string) { expired <- sToken })
+	}()
+
+	// emulate keyspace notifications: statistics keys are ignored
+	db := testDB.(*tokenDBR).db
+	channel := "__keyevent@0__:expired"
+	require.Eventually(t, func() bool {
+		return db.Publish(channel, clicksKey(testDBToken)).Val() > 0
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, db.Publish(channel, statsKey(testDBToken)).Err())
+	require.NoError(t, db.Publish(channel, testDBToken).Err())
+	require.Equal(t, testDBToken, <-expired)
+
+	cancel()
+	require.NoError(t, <-done)
+	require.Empty(t, expired)
+}
+
+// test expired tokens claiming and sweeping
+func Test05DBR21SweepExpired(t *testing.T) {
+	envSet(t)
+
+	testDBConfig, err := readConfig()
+	require.NoError(t, err)
+
+	testDB, err := NewTokenDB(testDBConfig.RedisAddrs, testDBConfig.RedisPassword)
+	require.NoError(t, err)
+	defer testDB.Close()
+	db := testDB.(*tokenDBR).db
+	tokens := []string{testDBToken + "1", testDBToken + "2", testDBToken + "3", testDBToken + "4"}
+	defer func() {
+		for _, sToken := range tokens {
+			testDB.Delete(sToken)
+		}
+	}()
+
+	// tokens with expiration are indexed by the expiration time
+	for _, sToken := range tokens {
+		ok, err := testDB.Set(sToken, "http://example.com/", 1)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	score, err := db.ZScore(expiringKey, tokens[0]).Result()
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(24*time.Hour).UnixMilli(), score, float64(time.Minute.Milliseconds()))
+	require.NoError(t, testDB.Expire(tokens[0], 2))
+	score, err = db.ZScore(expiringKey, tokens[0]).Result()
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(48*time.Hour).UnixMilli(), score, float64(time.Minute.Milliseconds()))
+	// expired immediately and deleted tokens are not indexed
+	require.NoError(t, testDB.Expire(tokens[0], -1))
+	require.NoError(t, testDB.Delete(tokens[1]))
+	for _, sToken := range tokens[:2] {
+		require.Equal(t, redis.Nil, db.ZScore(expiringKey, sToken).Err())
+	}
+	ok, err := testDB.Set(tokens[0], "http://example.com/", 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, redis.Nil, db.ZScore(expiringKey, tokens[0]).Err())
+
+	// nothing is expired yet
+	expired, err := testDB.SweepExpired(10)
+	require.NoError(t, err)
+	require.Empty(t, expired)
+
+	// emulate the expiration time of tokens[2] and tokens[3]: only removed token is expired
+	past := float64(time.Now().Add(-time.Minute).UnixMilli())
+	require.NoError(t, db.ZAdd(expiringKey, &redis.Z{Score: past, Member: tokens[2]}, &redis.Z{Score: past, Member: tokens[3]}).Err())
+	require.NoError(t, db.Del(tokens[3]).Err())
+	expired, err = testDB.SweepExpired(10)
+	require.NoError(t, err)
+	require.Equal(t, []string{tokens[3]}, expired)
+	// the expiration time of existing token is corrected
+	score, err = db.ZScore(expiringKey, tokens[2]).Result()
+	require.NoError(t, err)
+	require.Greater(t, score, float64(time.Now().UnixMilli()))
+
+	// the expired token is claimed once
+	claimed, err := testDB.ClaimExpired(tokens[3])
+	require.NoError(t, err)
+	require.False(t, claimed)
+	claimed, err = testDB.ClaimExpired(tokens[2])
+	require.NoError(t, err)
+	require.True(t, claimed)
+	claimed, err = testDB.ClaimExpired(tokens[2])
+	require.NoError(t, err)
+	require.False(t, claimed)
+}
+
 func Benchmark05DBR10set(b *testing.B) {
 	envSet(b)
 
@@ -0,0 +1,151 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains destination domains allowlist and blocklist
+
+import (
+	"bufio"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// destination domain rejection codes
+	urlErrBlocked    = "domain_blocked"     // the URL host matches the blocklist
+	urlErrNotAllowed = "domain_not_allowed" // the URL host doesn't match the allowlist
+)
+
+// hostRule is the rule of domains list: exact host, domain suffix (".example.com" matches example.com and all
+// its subdomains) or regular expression ("/.../" matches the whole host)
+type hostRule struct {
+	rule   string         // the rule as it is in the file (for logging)
+	host   string         // host of exact rule or domain of suffix rule in punycode
+	suffix bool           // the rule matches the domain and its subdomains
+	re     *regexp.Regexp // regular expression of regexp rule
+}
+
+// match returns true when the host matches the rule
+func (hr hostRule) match(host string) bool {
+	switch {
+	case hr.re != nil:
+		return hr.re.MatchString(host)
+	case hr.suffix:
+		return host == hr.host || strings.HasSuffix(host, "."+hr.host)
+	default:
+		return host == hr.host
+	}
+}
+
+// domainList is the list of host rules read from file. The rules are read when the configuration is read,
+// so they are reloaded together with the configuration.
+type domainList struct {
+	file  string     // rules file name, the list is not set when it is empty
+	rules []hostRule // rules of the list
+}
+
+// UnmarshalText reads the rules from the file: one rule per line, empty lines and lines started by '#' are skipped
+func (dl *domainList) UnmarshalText(text []byte) error {
+	list := domainList{file: strings.TrimSpace(string(text))}
+	if list.file == "" {
+		*dl = list
+		return nil
+	}
+	f, err := os.Open(list.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseHostRule(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", list.file, n, err)
+		}
+		list.rules = append(list.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s reading error: %w", list.file, err)
+	}
+	*dl = list
+	return nil
+}
+
+// parseHostRule parses the rule of domains list
+func parseHostRule(line string) (hostRule, error) {
+	rule := hostRule{rule: line}
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		re, err := regexp.Compile("^(?i:" + line[1:len(line)-1] + ")$")
+		if err != nil {
+			return rule, fmt.Errorf("wrong rule '%s': %w", line, err)
+		}
+		rule.re = re
+		return rule, nil
+	}
+	host, suffix := strings.CutPrefix(line, ".")
+	ascii, err := hostProfile.ToASCII(host)
+	if err != nil || ascii == "" {
+		return rule, fmt.Errorf("wrong rule '%s'", line)
+	}
+	rule.host, rule.suffix = ascii, suffix
+	return rule, nil
+}
+
+// match returns the first rule the host matches
+func (dl domainList) match(host string) (hostRule, bool) {
+	for _, rule := range dl.rules {
+		if rule.match(host) {
+			return rule, true
+		}
+	}
+	return hostRule{}, false
+}
+
+// checkDomain returns *urlError when the host of URL matches the blocklist or when the allowlist is set and the
+// host doesn't match it. The own host (the short domain host) is always allowed. The host of links that were
+// stored before the normalization appeared is normalized here.
+func checkDomain(url, own string, allow, block domainList) error {
+	if allow.file == "" && block.file == "" {
+		return nil
+	}
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return &urlError{urlErrMalformed, fmt.Sprintf("URL parsing error: %v", err)}
+	}
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		host = strings.ToLower(u.Hostname())
+	}
+	if rule, ok := block.match(host); ok {
+		return &urlError{urlErrBlocked, fmt.Sprintf("domain '%s' is blocked by rule '%s'", host, rule.rule)}
+	}
+	if _, ok := allow.match(host); allow.file != "" && host != own && !ok {
+		return &urlError{urlErrNotAllowed, fmt.Sprintf("domain '%s' is not allowed", host)}
+	}
+	return nil
+}
+
+// destinations returns all the URLs the link can redirect to
+func (l Link) destinations() []string {
+	urls := []string{l.URL}
+	if l.FallbackURL != "" {
+		urls = append(urls, l.FallbackURL)
+	}
+	for _, rt := range l.Routes {
+		urls = append(urls, rt.URL)
+	}
+	for _, v := range l.Variants {
+		urls = append(urls, v.URL)
+	}
+	return urls
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeDomainList writes the domains list file and returns the list read from it
+func writeDomainList(t *testing.T, content string) domainList {
+	file := filepath.Join(t.TempDir(), "domains.txt")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+	var list domainList
+	require.NoError(t, list.UnmarshalText([]byte(file)))
+	return list
+}
+
+func TestDomainList(t *testing.T) {
+	list := writeDomainList(t, "# company domains\n\nExample.com\n .corp.example\n/.*\\.pages\\.(dev|io)/\nпример.рф\n")
+	require.Len(t, list.rules, 4)
+	for host, rule := range map[string]string{
+		"example.com":           "Example.com",
+		"corp.example":          ".corp.example",
+		"wiki.corp.example":     ".corp.example",
+		"phish.pages.dev":       "/.*\\.pages\\.(dev|io)/",
+		"xn--e1afmkfd.xn--p1ai": "пример.рф",
+	} {
+		r, ok := list.match(host)
+		require.True(t, ok, host)
+		require.Equal(t, rule, r.rule, host)
+	}
+	for _, host := range []string{"www.example.com", "notcorp.example", "pages.dev.evil.com", "example.org"} {
+		_, ok := list.match(host)
+		require.False(t, ok, host)
+	}
+
+	require.NoError(t, list.UnmarshalText([]byte("")))
+	require.Equal(t, domainList{}, list)
+	file := filepath.Join(t.TempDir(), "wrong.txt")
+	require.Error(t, list.UnmarshalText([]byte(file)))
+	require.NoError(t, os.WriteFile(file, []byte("example.com\n/(/\n"), 0644))
+	require.ErrorContains(t, list.UnmarshalText([]byte(file)), "wrong.txt:2: wrong rule '/(/'")
+	require.NoError(t, os.WriteFile(file, []byte("exa mple.com\n"), 0644))
+	require.ErrorContains(t, list.UnmarshalText([]byte(file)), "wrong.txt:1: wrong rule 'exa mple.com'")
+}
+
+func TestCheckDomain(t *testing.T) {
+	allow := writeDomainList(t, ".example.com\n")
+	block := writeDomainList(t, "phish.example.com\n")
+	code := func(url string, allow, block domainList) string {
+		var urlErr *urlError
+		if err := checkDomain(url, "short.example", allow, block); errors.As(err, &urlErr) {
+			return urlErr.Code
+		}
+		return ""
+	}
+	require.Equal(t, "", code("https://www.example.com/", allow, block))
+	require.Equal(t, "", code("http://Example.COM:8080/", allow, block))
+	require.Equal(t, urlErrBlocked, code("https://phish.example.com/login", allow, block))
+	require.Equal(t, urlErrNotAllowed, code("https://example.org/", allow, block))
+	require.Equal(t, "", code("https://short.example/favicon.ico", allow, block))
+	require.Equal(t, "", code("https://example.org/", domainList{}, block))
+	require.Equal(t, urlErrBlocked, code("https://PHISH.example.com/", domainList{}, block))
+	require.Equal(t, "", code("javascript:alert(1)", domainList{}, domainList{}))
+	require.Equal(t, urlErrNotAllowed, code("https://example.org/", writeDomainList(t, "# nothing is allowed\n"), domainList{}))
+}
+
+func TestLinkDestinations(t *testing.T) {
+	link := Link{URL: "https://example.com/", LinkOptions: LinkOptions{
+		FallbackURL: "https://example.com/expired",
+		Routes:      []Route{{OS: osIOS, URL: "https://apps.apple.com/app/id1"}},
+		Variants:    []Variant{{Name: "a", URL: "https://example.com/a", Weight: 1}},
+	}}
+	require.Equal(t, []string{"https://example.com/", "https://example.com/expired", "https://apps.apple.com/app/id1", "https://example.com/a"}, link.destinations())
+	require.Equal(t, []string{"https://example.com/"}, Link{URL: "https://example.com/"}.destinations())
+}
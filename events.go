@@ -0,0 +1,101 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains live events feed
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	feedBufferSize = 100              // maximum number of events waiting for sending to single subscriber
+	feedHeartbeat  = 15 * time.Second // period of heartbeat comments in events stream
+
+	// eventRedirect is the live event of redirect (the other live event is eventCreated)
+	eventRedirect = "redirect"
+)
+
+// liveEvent is the event of live events feed
+type liveEvent struct {
+	Type  string    `json:"-"`               // event type: redirect or created
+	Token string    `json:"token"`           // token
+	Time  time.Time `json:"time"`            // event time
+	Bot   bool      `json:"bot,omitempty"`   // true for redirects of bots
+	Owner string    `json:"owner,omitempty"` // link owner
+}
+
+// feedSubscriber is the live events feed subscriber
+type feedSubscriber struct {
+	token   string         // token filter, all the tokens events are sent when it is empty
+	owner   string         // owner filter, events of all the links are sent when it is empty
+	events  chan liveEvent // events waiting for sending
+	dropped int64          // number of events dropped since the last sent event (guarded by feed mutex)
+}
+
+// eventFeed broadcasts live events to subscribers. Publishing never blocks: when subscriber doesn't
+// read events fast enough its buffer overflows and new events are dropped for this subscriber only.
+type eventFeed struct {
+	mu          sync.Mutex
+	subscribers map[*feedSubscriber]struct{}
+	done        chan struct{} // closed when the feed is closed
+	closeOnce   sync.Once
+}
+
+// newEventFeed returns new live events feed
+func newEventFeed() *eventFeed {
+	return &eventFeed{
+		subscribers: map[*feedSubscriber]struct{}{},
+		done:        make(chan struct{}),
+	}
+}
+
+// publish sends the event to all interested subscribers
+func (f *eventFeed) publish(e liveEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers {
+		if sub.token != "" && sub.token != e.Token || sub.owner != "" && sub.owner != e.Owner {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// subscribe adds new subscriber with token and owner filters
+func (f *eventFeed) subscribe(token, owner string) *feedSubscriber {
+	sub := &feedSubscriber{token: token, owner: owner, events: make(chan liveEvent, feedBufferSize)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe removes the subscriber
+func (f *eventFeed) unsubscribe(sub *feedSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, sub)
+}
+
+// takeDropped returns the number of events dropped for subscriber and resets it
+func (f *eventFeed) takeDropped(sub *feedSubscriber) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dropped := sub.dropped
+	sub.dropped = 0
+	return dropped
+}
+
+// close finishes all the events streams
+func (f *eventFeed) close() {
+	f.closeOnce.Do(func() { close(f.done) })
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFeed(t *testing.T) {
+	f := newEventFeed()
+	all := f.subscribe("", "")
+	one := f.subscribe("AAAAAA", "")
+	owned := f.subscribe("", "someone")
+	ownedOne := f.subscribe("BBBBBB", "someone")
+
+	f.publish(liveEvent{eventCreated, "AAAAAA", time.Now(), false, ""})
+	f.publish(liveEvent{eventRedirect, "BBBBBB", time.Now(), true, "someone"})
+	f.publish(liveEvent{eventRedirect, "CCCCCC", time.Now(), false, "another"})
+	require.Len(t, all.events, 3)
+	require.Len(t, one.events, 1)
+	require.Equal(t, "AAAAAA", (<-one.events).Token)
+	require.Len(t, owned.events, 1)
+	require.Equal(t, "BBBBBB", (<-owned.events).Token)
+	require.Len(t, ownedOne.events, 1)
+	f.unsubscribe(owned)
+	f.unsubscribe(ownedOne)
+	<-all.events
+
+	// slow subscriber doesn't block publishing
+	for range feedBufferSize {
+		f.publish(liveEvent{eventRedirect, "AAAAAA", time.Now(), false, ""})
+	}
+	require.Len(t, all.events, feedBufferSize)
+	require.Len(t, one.events, feedBufferSize)
+	require.Equal(t, int64(2), f.takeDropped(all))
+	require.Zero(t, f.takeDropped(all))
+	require.Zero(t, f.takeDropped(one))
+
+	f.unsubscribe(all)
+	f.unsubscribe(one)
+	f.publish(liveEvent{eventRedirect, "AAAAAA", time.Now(), false, ""})
+	require.Len(t, one.events, feedBufferSize)
+	require.Zero(t, f.takeDropped(one))
+
+	f.close()
+	f.close()
+	_, open := <-f.done
+	require.False(t, open)
+}
@@ -0,0 +1,56 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains GeoIP database interface
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIP resolves IP addresses to countries via local MaxMind format (.mmdb) database
+type geoIP struct {
+	db *maxminddb.Reader
+}
+
+// openGeoIP opens GeoIP database file, it returns nil geoIP when the file name is empty
+func openGeoIP(file string) (*geoIP, error) {
+	if file == "" {
+		return nil, nil
+	}
+	db, err := maxminddb.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("GeoIP database opening error: %w", err)
+	}
+	return &geoIP{db}, nil
+}
+
+// country returns ISO code of the IP address country or empty string when it is unknown
+func (g *geoIP) country(ip net.IP) string {
+	if g == nil || ip == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// close closes the GeoIP database
+func (g *geoIP) close() error {
+	if g == nil {
+		return nil
+	}
+	return g.db.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestGeoIP writes tiny IPv4 GeoIP database (MaxMind format): the addresses 128.0.0.0/1
+// belong to the country with iso code "XX" and there is no data for the rest of addresses.
+func writeTestGeoIP(t *testing.T, dir string) string {
+	// search tree: single node with 24 bits records, left record (0.0.0.0/1) is 'no data' (= node count),
+	// right record (128.0.0.0/1) points to the data section start (= node count + 16)
+	db := []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x11}
+	// data section separator
+	db = append(db, make([]byte, 16)...)
+	// data section: {"country": {"iso_code": "XX"}}
+	db = append(db, 0xE1, 0x47)
+	db = append(db, "country"...)
+	db = append(db, 0xE1, 0x48)
+	db = append(db, "iso_code"...)
+	db = append(db, 0x42, 'X', 'X')
+	// metadata
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, 0xE7)
+	for _, item := range []struct {
+		key   string
+		value []byte
+	}{
+		{"node_count", []byte{0xC1, 0x01}},                          // uint32 1
+		{"record_size", []byte{0xA1, 24}},                           // uint16 24
+		{"ip_version", []byte{0xA1, 4}},                             // uint16 4
+		{"database_type", append([]byte{0x44}, "Test"...)},          // string "Test"
+		{"binary_format_major_version", []byte{0xA1, 2}},            // uint16 2
+		{"binary_format_minor_version", []byte{0xA0}},               // uint16 0
+		{"build_epoch", []byte{0x04, 0x02, 0x65, 0x00, 0x00, 0x00}}, // uint64
+	} {
+		db = append(db, 0x40|byte(len(item.key)))
+		db = append(db, item.key...)
+		db = append(db, item.value...)
+	}
+	file := filepath.Join(dir, "test.mmdb")
+	require.NoError(t, os.WriteFile(file, db, 0644))
+	return file
+}
+
+func TestGeoIP(t *testing.T) {
+	geo, err := openGeoIP(writeTestGeoIP(t, t.TempDir()))
+	require.NoError(t, err)
+	defer geo.close()
+
+	require.Equal(t, "XX", geo.country(net.ParseIP("192.0.2.1")))
+	require.Equal(t, "", geo.country(net.ParseIP("10.0.0.1")))
+	require.Equal(t, "", geo.country(nil))
+}
+
+func TestGeoIPNoFile(t *testing.T) {
+	geo, err := openGeoIP("")
+	require.NoError(t, err)
+	require.Nil(t, geo)
+	require.Equal(t, "", geo.country(net.ParseIP("192.0.2.1")))
+	require.NoError(t, geo.close())
+
+	_, err = openGeoIP(filepath.Join(t.TempDir(), "wrong.mmdb"))
+	require.Error(t, err)
+}
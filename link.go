@@ -0,0 +1,244 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains short link record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Link is the short link record stored by token: long URL and per-link options
+type Link struct {
+	URL string `json:"url"` // long URL
+	LinkOptions
+	PasswordHash string    `json:"password_hash,omitempty"` // bcrypt hash of the password of protected link
+	Created      time.Time `json:"created,omitzero"`        // link creation time in the records of previous versions (it is stored separately now)
+}
+
+// LinkOptions are the per-link options, they are accepted by request for short URL and returned by request for token information
+type LinkOptions struct {
+	Redirect    int       `json:"redirect,omitempty"`     // redirect status code, the default one (from configuration) is used when it is 0
+	PassQuery   bool      `json:"pass_query,omitempty"`   // append query parameters of redirect request to long URL
+	PassPath    bool      `json:"pass_path,omitempty"`    // append path suffix of redirect request (after token) to long URL path
+	UTM         *UTM      `json:"utm,omitempty"`          // UTM parameters to add to long URL
+	MaxClicks   int       `json:"max_clicks,omitempty"`   // maximum number of redirects, the number is not limited when it is 0
+	NotBefore   time.Time `json:"not_before,omitzero"`    // time of link activation, the link is active right after creation when it is not set
+	FallbackURL string    `json:"fallback_url,omitempty"` // URL to redirect to after the link expiration
+	Title       string    `json:"title,omitempty"`        // link title for preview page
+	Preview     bool      `json:"preview,omitempty"`      // always show preview page instead of redirect
+	Routes      []Route   `json:"routes,omitempty"`       // device routing rules, the long URL is the default target
+	Variants    []Variant `json:"variants,omitempty"`     // weighted targets that replace the default target
+	Sticky      bool      `json:"sticky,omitempty"`       // keep the variant assigned to visitor by cookie
+	Owner       string    `json:"owner,omitempty"`        // link owner identifier for live events filtering
+}
+
+// pending returns true when the link is not active yet
+func (o LinkOptions) pending() bool {
+	return time.Now().Before(o.NotBefore)
+}
+
+// setPassword protects the link by the password
+func (l *Link) setPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("password hashing error: %w", err)
+	}
+	l.PasswordHash = string(hash)
+	return nil
+}
+
+// checkPassword returns true when the password of protected link is correct
+func (l Link) checkPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+}
+
+// redirectCodes are the supported redirect status codes
+var redirectCodes = []int{http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect}
+
+// checkRedirectCode returns error when the code is not supported redirect status code
+func checkRedirectCode(code int) error {
+	if !slices.Contains(redirectCodes, code) {
+		return fmt.Errorf("unsupported redirect status code %d", code)
+	}
+	return nil
+}
+
+// encode returns the value to store in database. The link without options is stored as plain long URL
+// (as all links were stored before the options appeared), the link with options is stored as JSON.
+func (l Link) encode() string {
+	options := l
+	options.URL = ""
+	if reflect.ValueOf(options).IsZero() {
+		return l.URL
+	}
+	value, _ := json.Marshal(l)
+	return string(value)
+}
+
+// decodeLink parses the value stored in database. Long URLs always start with scheme, so JSON value is
+// recognized by the leading '{'.
+func decodeLink(value string) (Link, error) {
+	if !strings.HasPrefix(value, "{") {
+		return Link{URL: value}, nil
+	}
+	var link Link
+	if err := json.Unmarshal([]byte(value), &link); err != nil {
+		return Link{}, fmt.Errorf("link record parsing error: %w", err)
+	}
+	return link, nil
+}
+
+// check returns error when the link options are wrong
+func (o LinkOptions) check() error {
+	if o.Redirect != 0 {
+		if err := checkRedirectCode(o.Redirect); err != nil {
+			return err
+		}
+	}
+	if o.MaxClicks < 0 {
+		return fmt.Errorf("wrong maximum number of clicks %d", o.MaxClicks)
+	}
+	if o.FallbackURL != "" {
+		if err := checkHTTPURL("fallback", o.FallbackURL); err != nil {
+			return err
+		}
+	}
+	if err := checkRoutes(o.Routes); err != nil {
+		return err
+	}
+	if o.Sticky && len(o.Variants) == 0 {
+		return errors.New("sticky assignment requires variants")
+	}
+	return checkVariants(o.Variants)
+}
+
+// checkHTTPURL returns error when the URL is not absolute HTTP(S) URL, the name is used in error message
+func checkHTTPURL(name, url string) error {
+	if u, err := neturl.Parse(url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("wrong %s URL '%s'", name, url)
+	}
+	return nil
+}
+
+// normalize normalizes the fallback, route and variant URLs the same way as the long URL, so they are checked by
+// destination domains rules in the same form. The options have to be checked before. The returned error is *urlError.
+func (o *LinkOptions) normalize() error {
+	normalize := func(name string, url *string) error {
+		normalized, err := normalizeURL(*url, []string{"http", "https"})
+		if urlErr, ok := err.(*urlError); ok {
+			return &urlError{urlErr.Code, fmt.Sprintf("%s URL: %s", name, urlErr.Message)}
+		}
+		*url = normalized
+		return nil
+	}
+	if o.FallbackURL != "" {
+		if err := normalize("fallback", &o.FallbackURL); err != nil {
+			return err
+		}
+	}
+	for i := range o.Routes {
+		if err := normalize(fmt.Sprintf("route %d", i+1), &o.Routes[i].URL); err != nil {
+			return err
+		}
+	}
+	for i := range o.Variants {
+		if err := normalize(fmt.Sprintf("variant %d", i+1), &o.Variants[i].URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// target returns the URL to redirect to: the long URL with the path suffix and the query of redirect request
+// when the link passes them and with the UTM parameters of the link. The parameters that are already in the
+// long URL are never overridden, the passed query parameters are not overridden by UTM parameters. The suffix
+// and the query have to be escaped. The suffix with ".." segment is rejected as it could lead out of the long
+// URL path.
+func (l Link) target(suffix, query string) (string, error) {
+	if !l.PassPath {
+		suffix = ""
+	}
+	if unescaped, err := neturl.PathUnescape(suffix); err != nil || slices.Contains(strings.Split(unescaped, "/"), "..") {
+		return "", fmt.Errorf("wrong path suffix '%s'", suffix)
+	}
+	if !l.PassQuery {
+		query = ""
+	}
+	utm := l.UTM.query()
+	if suffix == "" && query == "" && utm == "" {
+		return l.URL, nil
+	}
+	u, err := neturl.Parse(l.URL)
+	if err != nil {
+		return "", fmt.Errorf("long URL parsing error: %w", err)
+	}
+	if suffix != "" {
+		u = u.JoinPath(suffix)
+	}
+	u.RawQuery = mergeQuery(mergeQuery(u.RawQuery, query), utm)
+	return u.String(), nil
+}
+
+// mergeQuery appends the parameters of added query to the query, the parameters with names that are already
+// in the query are skipped. Both queries are kept as they are (without re-encoding).
+func mergeQuery(query, added string) string {
+	if added == "" {
+		return query
+	}
+	own, _ := neturl.ParseQuery(query)
+	params := []string{}
+	if query != "" {
+		params = append(params, query)
+	}
+	for param := range strings.SplitSeq(added, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if name, err := neturl.QueryUnescape(name); err != nil || name == "" || own.Has(name) {
+			continue
+		}
+		params = append(params, param)
+	}
+	return strings.Join(params, "&")
+}
+
+// UTM are the UTM parameters that are added to long URL on redirect
+type UTM struct {
+	Source   string `json:"source,omitempty"`   // utm_source
+	Medium   string `json:"medium,omitempty"`   // utm_medium
+	Campaign string `json:"campaign,omitempty"` // utm_campaign
+	Term     string `json:"term,omitempty"`     // utm_term
+	Content  string `json:"content,omitempty"`  // utm_content
+}
+
+// query returns the encoded query of the UTM parameters (in the order of fields)
+func (u *UTM) query() string {
+	if u == nil {
+		return ""
+	}
+	params := []string{}
+	for _, p := range [][2]string{
+		{"utm_source", u.Source},
+		{"utm_medium", u.Medium},
+		{"utm_campaign", u.Campaign},
+		{"utm_term", u.Term},
+		{"utm_content", u.Content},
+	} {
+		if p[1] != "" {
+			params = append(params, p[0]+"="+neturl.QueryEscape(p[1]))
+		}
+	}
+	return strings.Join(params, "&")
+}
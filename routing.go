@@ -0,0 +1,215 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains link targets routing
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	maxRoutes        = 20                     // maximum number of routing rules of link
+	maxVariants      = 10                     // maximum number of variants of link
+	maxVariantName   = 32                     // maximum length of variant name
+	variantCookie    = "urlshortener_variant" // cookie of sticky variant, its path is the short URL path
+	variantCookieAge = 30 * 24 * 3600         // sticky variant cookie lifetime in seconds
+
+	// operating systems
+	osIOS     = "ios"
+	osAndroid = "android"
+	osWindows = "windows"
+	osMacOS   = "macos"
+	osLinux   = "linux"
+	osOther   = "other"
+
+	// device classes
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+	deviceDesktop = "desktop"
+)
+
+var (
+	// routeOSes are the operating systems supported by routing rules
+	routeOSes = []string{osIOS, osAndroid, osWindows, osMacOS, osLinux, osOther}
+	// routeDevices are the device classes supported by routing rules
+	routeDevices = []string{deviceMobile, deviceTablet, deviceDesktop}
+)
+
+// Route is the routing rule of link: the target is used when the request matches all the set conditions
+type Route struct {
+	OS      string `json:"os,omitempty"`      // operating system of user agent
+	Device  string `json:"device,omitempty"`  // device class of user agent
+	Country string `json:"country,omitempty"` // ISO code of client country (resolved via GeoIP database)
+	URL     string `json:"url"`               // target URL
+}
+
+// Variant is the weighted target of link
+type Variant struct {
+	Name   string `json:"name"`   // variant name for statistics and sticky assignment
+	URL    string `json:"url"`    // target URL
+	Weight int    `json:"weight"` // relative weight of variant, the variant is not used when it is 0
+}
+
+// match returns true when the user agent operating system, device class and client country match the rule.
+// The rule with country never matches when the country is unknown.
+func (rt Route) match(os, device, country string) bool {
+	return (rt.OS == "" || rt.OS == os) && (rt.Device == "" || rt.Device == device) &&
+		(rt.Country == "" || country != "" && strings.EqualFold(rt.Country, country))
+}
+
+// checkRoutes returns error when any routing rule is wrong
+func checkRoutes(routes []Route) error {
+	if len(routes) > maxRoutes {
+		return fmt.Errorf("too many routes: %d (maximum is %d)", len(routes), maxRoutes)
+	}
+	for i, rt := range routes {
+		switch {
+		case rt.OS == "" && rt.Device == "" && rt.Country == "":
+			return fmt.Errorf("route %d has no conditions", i+1)
+		case rt.OS != "" && !slices.Contains(routeOSes, rt.OS):
+			return fmt.Errorf("route %d has unknown os '%s'", i+1, rt.OS)
+		case rt.Device != "" && !slices.Contains(routeDevices, rt.Device):
+			return fmt.Errorf("route %d has unknown device '%s'", i+1, rt.Device)
+		case rt.Country != "" && !validCountry(rt.Country):
+			return fmt.Errorf("route %d has wrong country '%s'", i+1, rt.Country)
+		}
+		if err := checkHTTPURL(fmt.Sprintf("route %d", i+1), rt.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVariants returns error when any variant is wrong
+func checkVariants(variants []Variant) error {
+	if len(variants) > maxVariants {
+		return fmt.Errorf("too many variants: %d (maximum is %d)", len(variants), maxVariants)
+	}
+	total := 0
+	names := map[string]bool{}
+	for i, v := range variants {
+		switch {
+		case !validVariantName(v.Name):
+			return fmt.Errorf("variant %d has wrong name '%s'", i+1, v.Name)
+		case names[v.Name]:
+			return fmt.Errorf("variant %d has duplicate name '%s'", i+1, v.Name)
+		case v.Weight < 0:
+			return fmt.Errorf("variant %d has negative weight", i+1)
+		}
+		if err := checkHTTPURL(fmt.Sprintf("variant %d", i+1), v.URL); err != nil {
+			return err
+		}
+		names[v.Name] = true
+		total += v.Weight
+	}
+	if len(variants) > 0 && total == 0 {
+		return errors.New("total weight of variants is 0")
+	}
+	return nil
+}
+
+// validCountry returns true when the country is two letters ISO code
+func validCountry(country string) bool {
+	return len(country) == 2 && !strings.ContainsFunc(country, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+}
+
+// validVariantName returns true when the name is not empty and it consists of letters, digits, '-' and '_' only
+// (the name is used in statistics and in cookie)
+func validVariantName(name string) bool {
+	return name != "" && len(name) <= maxVariantName && !strings.ContainsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	})
+}
+
+// route returns the long URL for the request and the name of chosen variant: the URL of the first matching
+// routing rule, the URL of variant or the default long URL. The client country is resolved via GeoIP database
+// (it can be nil) only when any rule has the country condition. The variant is taken from sticky variant cookie
+// when the link keeps the variants assignment, otherwise it is chosen randomly by weights. The variant name
+// is empty when no variant is chosen.
+func (l Link) route(r *http.Request, geo *geoIP) (string, string) {
+	if len(l.Routes) > 0 {
+		os, device := uaPlatform(r.UserAgent())
+		country := ""
+		if slices.ContainsFunc(l.Routes, func(rt Route) bool { return rt.Country != "" }) {
+			country = geo.country(clientIP(r))
+		}
+		for _, rt := range l.Routes {
+			if rt.match(os, device, country) {
+				return rt.URL, ""
+			}
+		}
+	}
+	if len(l.Variants) == 0 {
+		return l.URL, ""
+	}
+	if l.Sticky {
+		if cookie, err := r.Cookie(variantCookie); err == nil {
+			for _, v := range l.Variants {
+				if v.Name == cookie.Value && v.Weight > 0 {
+					return v.URL, v.Name
+				}
+			}
+		}
+	}
+	total := 0
+	for _, v := range l.Variants {
+		total += v.Weight
+	}
+	n := rand.IntN(total)
+	for _, v := range l.Variants {
+		if n -= v.Weight; n < 0 {
+			return v.URL, v.Name
+		}
+	}
+	return l.URL, ""
+}
+
+// stickVariant sets the cookie of sticky variant of the short URL
+func stickVariant(w http.ResponseWriter, sToken, variant string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     variantCookie,
+		Value:    variant,
+		Path:     "/" + sToken,
+		MaxAge:   variantCookieAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// uaPlatform returns the operating system and device class of user agent. Note that iPadOS browsers
+// request desktop sites by default and they can't be distinguished from macOS ones.
+func uaPlatform(userAgent string) (string, string) {
+	ua := strings.ToLower(userAgent)
+	os := osOther
+	switch {
+	case containsAny(ua, []string{"iphone", "ipad", "ipod"}):
+		os = osIOS
+	case strings.Contains(ua, "android"):
+		os = osAndroid
+	case strings.Contains(ua, "windows"):
+		os = osWindows
+	case containsAny(ua, []string{"macintosh", "mac os x"}):
+		os = osMacOS
+	case strings.Contains(ua, "linux"):
+		os = osLinux
+	}
+	device := deviceDesktop
+	switch {
+	case containsAny(ua, []string{"ipad", "tablet"}) || os == osAndroid && !strings.Contains(ua, "mobile"):
+		device = deviceTablet
+	case containsAny(ua, []string{"mobile", "iphone", "ipod", "windows phone"}):
+		device = deviceMobile
+	}
+	return os, device
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUAPlatform(t *testing.T) {
+	for ua, platform := range map[string][2]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148":           {osIOS, deviceMobile},
+		"Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148":                    {osIOS, deviceTablet},
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36":       {osAndroid, deviceMobile},
+		"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 Chrome/120.0 Safari/537.36":              {osAndroid, deviceTablet},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36":             {osWindows, deviceDesktop},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Version/17.0 Safari/605.1.15":      {osMacOS, deviceDesktop},
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":                              {osLinux, deviceDesktop},
+		"Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1) AppleWebKit/537.36 Chrome/52.0 Mobile Safari/537.36": {osAndroid, deviceMobile},
+		"curl/8.0": {osOther, deviceDesktop},
+		"":         {osOther, deviceDesktop},
+	} {
+		os, device := uaPlatform(ua)
+		require.Equal(t, platform, [2]string{os, device}, ua)
+	}
+}
+
+func TestLinkRoute(t *testing.T) {
+	link := Link{URL: "https://example.com/", LinkOptions: LinkOptions{Routes: []Route{
+		{OS: osIOS, URL: "https://apps.apple.com/app/id1"},
+		{OS: osAndroid, Device: deviceMobile, URL: "https://play.google.com/store/apps/details?id=app"},
+		{Device: deviceTablet, URL: "https://example.com/tablet"},
+	}}}
+	route := func(ua string) string {
+		r := httptest.NewRequest("GET", "/AAAAAA", nil)
+		r.Header.Set("User-Agent", ua)
+		url, variant := link.route(r, nil)
+		require.Empty(t, variant)
+		return url
+	}
+	require.Equal(t, "https://apps.apple.com/app/id1", route("Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) Mobile/15E148"))
+	require.Equal(t, "https://play.google.com/store/apps/details?id=app", route("Mozilla/5.0 (Linux; Android 14) Mobile Safari/537.36"))
+	require.Equal(t, "https://example.com/tablet", route("Mozilla/5.0 (Linux; Android 13; SM-X700) Safari/537.36"))
+	require.Equal(t, "https://example.com/", route("Mozilla/5.0 (Windows NT 10.0; Win64; x64)"))
+	url, variant := Link{URL: "https://example.com/"}.route(httptest.NewRequest("GET", "/AAAAAA", nil), nil)
+	require.Equal(t, "https://example.com/", url)
+	require.Empty(t, variant)
+}
+
+func TestLinkGeoRoute(t *testing.T) {
+	geo, err := openGeoIP(writeTestGeoIP(t, t.TempDir()))
+	require.NoError(t, err)
+	defer geo.close()
+
+	link := Link{URL: "https://example.com/", LinkOptions: LinkOptions{Routes: []Route{
+		{OS: osIOS, Country: "XX", URL: "https://example.com/xx/ios"},
+		{Country: "xx", URL: "https://example.com/xx"},
+		{Country: "YY", URL: "https://example.com/yy"},
+	}}}
+	route := func(remoteAddr, ua string, geo *geoIP) string {
+		r := httptest.NewRequest("GET", "/AAAAAA", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("User-Agent", ua)
+		url, _ := link.route(r, geo)
+		return url
+	}
+	require.Equal(t, "https://example.com/xx", route("192.0.2.1:1234", "curl/8.0", geo))
+	require.Equal(t, "https://example.com/xx/ios", route("192.0.2.1:1234", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148", geo))
+	require.Equal(t, "https://example.com/", route("10.0.0.1:1234", "curl/8.0", geo))
+	require.Equal(t, "https://example.com/", route("192.0.2.1:1234", "curl/8.0", nil))
+}
+
+func TestCheckRoutes(t *testing.T) {
+	require.NoError(t, checkRoutes(nil))
+	require.NoError(t, checkRoutes([]Route{{OS: osIOS, URL: "https://apps.apple.com/"}, {Device: deviceDesktop, URL: "http://example.com/"}, {Country: "de", URL: "https://example.de/"}}))
+	for _, c := range []struct {
+		routes []Route
+		err    string
+	}{
+		{[]Route{{URL: "https://example.com/"}}, "route 1 has no conditions"},
+		{[]Route{{OS: osIOS, URL: "https://example.com/"}, {OS: "symbian", URL: "https://example.com/"}}, "route 2 has unknown os 'symbian'"},
+		{[]Route{{Device: "watch", URL: "https://example.com/"}}, "route 1 has unknown device 'watch'"},
+		{[]Route{{Country: "USA", URL: "https://example.com/"}}, "route 1 has wrong country 'USA'"},
+		{[]Route{{OS: osIOS, URL: "apps.apple.com"}}, "wrong route 1 URL 'apps.apple.com'"},
+		{make([]Route, maxRoutes+1), "too many routes: 21 (maximum is 20)"},
+	} {
+		require.EqualError(t, checkRoutes(c.routes), c.err)
+	}
+	require.ErrorContains(t, LinkOptions{Routes: []Route{{OS: strings.ToUpper(osIOS), URL: "https://example.com/"}}}.check(), "unknown os")
+}
+
+func TestLinkVariants(t *testing.T) {
+	link := Link{URL: "https://example.com/", LinkOptions: LinkOptions{
+		Routes: []Route{{OS: osIOS, URL: "https://apps.apple.com/app/id1"}},
+		Variants: []Variant{
+			{Name: "a", URL: "https://example.com/a", Weight: 3},
+			{Name: "b", URL: "https://example.com/b", Weight: 1},
+			{Name: "off", URL: "https://example.com/off", Weight: 0},
+		},
+	}}
+	counts := map[string]int{}
+	for range 4000 {
+		url, variant := link.route(httptest.NewRequest("GET", "/AAAAAA", nil), nil)
+		require.Equal(t, "https://example.com/"+variant, url)
+		counts[variant]++
+	}
+	require.Zero(t, counts["off"])
+	require.InDelta(t, 3000, counts["a"], 200)
+	require.InDelta(t, 1000, counts["b"], 200)
+
+	// device routes are evaluated first
+	r := httptest.NewRequest("GET", "/AAAAAA", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148")
+	url, variant := link.route(r, nil)
+	require.Equal(t, "https://apps.apple.com/app/id1", url)
+	require.Empty(t, variant)
+
+	// sticky variant is taken from cookie (if it is still used)
+	r = httptest.NewRequest("GET", "/AAAAAA", nil)
+	r.AddCookie(&http.Cookie{Name: variantCookie, Value: "b"})
+	variants := map[string]bool{}
+	for range 100 {
+		_, variant = link.route(r, nil)
+		variants[variant] = true
+	}
+	require.True(t, variants["a"], "cookie is ignored for not sticky link")
+	link.Sticky = true
+	for range 100 {
+		_, variant = link.route(r, nil)
+		require.Equal(t, "b", variant)
+	}
+	r = httptest.NewRequest("GET", "/AAAAAA", nil)
+	r.AddCookie(&http.Cookie{Name: variantCookie, Value: "off"})
+	_, variant = link.route(r, nil)
+	require.Contains(t, []string{"a", "b"}, variant)
+}
+
+func TestCheckVariants(t *testing.T) {
+	require.NoError(t, checkVariants(nil))
+	require.NoError(t, checkVariants([]Variant{{Name: "A-1_b", URL: "https://example.com/a", Weight: 1}, {Name: "b", URL: "http://example.com/b"}}))
+	for _, c := range []struct {
+		variants []Variant
+		err      string
+	}{
+		{[]Variant{{Name: "", URL: "https://example.com/", Weight: 1}}, "variant 1 has wrong name ''"},
+		{[]Variant{{Name: "a b", URL: "https://example.com/", Weight: 1}}, "variant 1 has wrong name 'a b'"},
+		{[]Variant{{Name: strings.Repeat("a", maxVariantName+1), URL: "https://example.com/", Weight: 1}}, "variant 1 has wrong name '" + strings.Repeat("a", maxVariantName+1) + "'"},
+		{[]Variant{{Name: "a", URL: "https://example.com/", Weight: 1}, {Name: "a", URL: "https://example.com/", Weight: 1}}, "variant 2 has duplicate name 'a'"},
+		{[]Variant{{Name: "a", URL: "https://example.com/", Weight: -1}}, "variant 1 has negative weight"},
+		{[]Variant{{Name: "a", URL: "example.com", Weight: 1}}, "wrong variant 1 URL 'example.com'"},
+		{[]Variant{{Name: "a", URL: "https://example.com/"}}, "total weight of variants is 0"},
+		{make([]Variant, maxVariants+1), "too many variants: 11 (maximum is 10)"},
+	} {
+		require.EqualError(t, checkVariants(c.variants), c.err)
+	}
+	require.EqualError(t, LinkOptions{Sticky: true}.check(), "sticky assignment requires variants")
+}
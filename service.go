@@ -8,13 +8,21 @@ package main
 // This file contains service handler interface
 
 import (
+	"cmp"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"os"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -36,6 +44,10 @@ const (
 		<br><br>
 		Service status: healthy, %d attempts per %d ms
 		<br><br>
+		Service mode: %s
+		<br><br>
+		Dropped click events: %d
+		<br><br>
 		<a href=/ui/generate>Create short URL manually</a>
 		<br><br><br><br>
 		See sources at <a href="https://github.com/slytomcat/URLshortener">https://github.com/slytomcat/URLshortener</a>
@@ -68,6 +80,61 @@ QR code for short URL:
 <br>
 Short URL lifetime: %d days
 <br>`
+	// usedLinkPage is the default page to respond on redirect by used up click limited link
+	usedLinkPage = `
+<html>
+	<head>
+		<title>Link already used</title>
+	</head>
+	<body>
+		<h1>Link already used</h1>
+		<br>
+		This link can't be used any more.
+	</body>
+</html>`
+	// passwordPage is the password form of protected link, it is posted to the short URL
+	passwordPage = `
+<html>
+	<head>
+		<title>Protected link</title>
+	</head>
+	<body>
+		<h1>This link is protected by password</h1>
+		<br>
+		%s
+		<form method="POST">
+			<input type=password name=password title="password">
+			<input type=submit value="open link">
+		</form>
+	</body>
+</html>`
+	// previewPage is the preview page of short link that shows the destination before redirect
+	previewPage = `
+<html>
+	<head>
+		<title>Link preview</title>
+	</head>
+	<body>
+		<h1>%s</h1>
+		<br>
+		This short link leads to:
+		<br><br>
+		<b>%s</b>
+		<br><br>
+		%s
+		<a href="%s">Continue</a>
+	</body>
+</html>`
+	// previewSuffix is the token suffix of preview request
+	previewSuffix = "+"
+	// tokenInfoPath is the path prefix of token information request
+	tokenInfoPath = "/api/v1/token/"
+	// tokenStatsSuffix is the path suffix of token clicks statistics request
+	tokenStatsSuffix = "/stats"
+	// expiredSweepInterval is the period of sweeping the tokens expired by TTL
+	expiredSweepInterval = time.Minute
+	// expiredSweepBatch is the maximum number of expired tokens claimed by single sweep request
+	expiredSweepBatch = 100
 )
 
 var (
@@ -80,22 +147,33 @@ var (
 type ServiceHandler interface {
 	ServeHTTP(http.ResponseWriter, *http.Request) // http server handler function
 	healthCheck() error                           // Health-check function
+	reload() error                                // Configuration reload method
 	start() error                                 // Service start method
 	stop()                                        // Service stop method
 }
 
 // serviceHandler is an instance of ServiceHandler interface
 type serviceHandler struct {
-	tokenDB    TokenDB      // Database interface
-	shortToken ShortToken   // Short token generator
-	config     *Config      // service configuration
-	server     *http.Server // service server
-	attempts   int32        // calculated number of attempts during time-out
+	tokenDB    TokenDB                // Database interface
+	shortToken ShortToken             // Short token generator
+	config     atomic.Pointer[Config] // service configuration (it is replaced on configuration reload)
+	server     *http.Server           // service server
+	httpServer *http.Server           // HTTP to HTTPS redirect server (nil when it is not configured)
+	internal   *http.Server           // internal listener server (nil when it is not configured)
+	certs      *certReloader          // TLS certificate holder (nil when HTTPS is not configured)
+	clicks     *clickCounter          // clicks counter
+	webhooks   *webhookDispatcher     // click events dispatcher
+	feed       *eventFeed             // live events feed
+	attempts   int32                  // calculated number of attempts during time-out
+	ctx        context.Context        // service context, it is canceled on stop
+	cancel     context.CancelFunc     // service context cancel function
 }
 
 // ServeHTTP implement simple mux that selects the handler function according to request URL
 func (s *serviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println("access from:", r.RemoteAddr, r.Method, r.RequestURI, r.Header)
+	// resolve the client IP address once, it is available to all handlers via clientIP(r)
+	r = withClientIP(r, s.conf().TrustedProxies.resolve(r, s.conf().ProxyHeader))
+	log.Println("access from:", clientIP(r), r.Method, r.RequestURI, loggedHeader(r.Header))
 	switch r.Method + r.URL.Path {
 	case "GET/":
 		// request for home page
@@ -121,6 +199,30 @@ func (s *serviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		s.expire(w, r, body)
+	case "POST/api/v1/update":
+		// request for long URL change
+		body, err := readBody(r)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.update(w, r, body)
+	case "POST/api/v1/delete":
+		// request for token deletion
+		body, err := readBody(r)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.delete(w, r, body)
+	case "POST/api/v1/admin/reload":
+		// request for configuration reload
+		s.reloadRequest(w, r)
+	case "GET/api/v1/events":
+		// request for live events feed
+		s.events(w, r)
 	case "GET/ui/generate":
 		// UI short URL generation page
 		s.generate(w, r)
@@ -129,16 +231,39 @@ func (s *serviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// In this code it is used for health check (as point to redirect from short url)
 		w.Write(favicon)
 	default:
-		// all the rest GET requests are requests for redirect (probably)
-		if r.Method == "GET" {
-			s.redirect(w, r)
-		} else {
+		switch {
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, tokenInfoPath) && strings.HasSuffix(r.URL.Path, tokenStatsSuffix):
+			// request for token clicks statistics
+			s.stats(w, r, strings.TrimSuffix(r.URL.Path[len(tokenInfoPath):], tokenStatsSuffix))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, tokenInfoPath):
+			// request for token information
+			s.info(w, r, r.URL.Path[len(tokenInfoPath):])
+		case r.Method == "GET" || r.Method == "HEAD" || r.URL.Path != "/" && !strings.HasPrefix(r.URL.Path, "/api/"):
+			// all the rest GET (and HEAD) requests are requests for redirect (probably), the other methods are
+			// password form submits of protected links or requests by links that preserve the request method:
+			// the first path segment is token, the rest of path is the suffix to pass to long URL
+			sToken, suffix, _ := strings.Cut(r.URL.EscapedPath()[1:], "/") // GET and HEAD always contain at least "/" in URL
+			// the token with preview suffix is the request for preview page
+			sToken, preview := strings.CutSuffix(sToken, previewSuffix)
+			s.redirect(w, r, sToken, suffix, preview)
+		default:
 			log.Printf("bad method/path: %s %s", r.Method, r.URL.Path)
 			w.WriteHeader(http.StatusBadRequest)
 		}
 	}
 }
 
+// loggedHeader returns the copy of request header where the credentials are redacted
+func loggedHeader(header http.Header) http.Header {
+	logged := header.Clone()
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if logged.Get(name) != "" {
+			logged.Set(name, "[redacted]")
+		}
+	}
+	return logged
+}
+
 // readBody reads request body and format error
 func readBody(r *http.Request) ([]byte, error) {
 	body, err := io.ReadAll(r.Body)
@@ -150,9 +275,9 @@ func readBody(r *http.Request) ([]byte, error) {
 
 // generate is UI short URL|QR generator
 func (s *serviceHandler) generate(w http.ResponseWriter, r *http.Request) {
-	rMess := fmt.Sprintf("UI generate request from %s (%s)", r.RemoteAddr, r.Referer())
+	rMess := fmt.Sprintf("UI generate request from %s (%s)", clientIP(r), r.Referer())
 	// check that service mode allows this request
-	if s.config.Mode&disableUI != 0 {
+	if s.mode(r)&disableUI != 0 {
 		log.Printf("%s: this request is disabled by current service mode\n", rMess)
 		// send 404 response
 		http.NotFound(w, r)
@@ -162,17 +287,25 @@ func (s *serviceHandler) generate(w http.ResponseWriter, r *http.Request) {
 	part := ""
 
 	if url != "" {
-		// TO DO: make more sophisticated check for URL
 		// if URL provided then make short URL for it
-		sToken, err := s.generateToken(url, s.config.DefaultExp)
+		longURL, err := normalizeURL(url, s.conf().URLSchemes)
+		if err == nil {
+			err = s.checkDomains(longURL)
+		}
+		if err != nil {
+			log.Printf("%s: long URL is rejected: %v", rMess, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sToken, err := s.generateToken(Link{URL: longURL}, s.conf().DefaultExp)
 
 		if err != nil {
 			log.Printf("%s: token generation error: %v", rMess, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		sURL := s.config.ShortDomain + "/" + sToken
-		part = fmt.Sprintf(generatorPagePart, sURL, sURL, s.config.DefaultExp)
+		sURL := s.shortURL(sToken)
+		part = fmt.Sprintf(generatorPagePart, sURL, sURL, s.conf().DefaultExp)
 		rMess = fmt.Sprintf("%s: new token generated: %s", rMess, sToken)
 	}
 
@@ -188,14 +321,16 @@ curl -i -v http://localhost:8080/
 
 // Home shows home page
 func (s *serviceHandler) home(w http.ResponseWriter, r *http.Request) {
-	log.Printf("home page request from %s (%s)", r.RemoteAddr, r.Referer())
+	log.Printf("home page request from %s (%s)", clientIP(r), r.Referer())
 	// show the home page
 	w.Write(fmt.Appendf(nil,
 		homePage,
 		"Home page of URLshortener",
 		version,
 		atomic.LoadInt32(&s.attempts),
-		s.config.Timeout))
+		s.conf().Timeout,
+		s.mode(r),
+		s.webhooks.dropped.Load()))
 }
 
 /* test for test env:
@@ -204,7 +339,7 @@ curl -i -v http://localhost:8080/healthcheck
 
 // healthcheck also shows home page if self-check successfully passed
 func (s *serviceHandler) healthcheck(w http.ResponseWriter, r *http.Request) {
-	rMess := fmt.Sprintf("health-check request from %s (%s)", r.RemoteAddr, r.Referer())
+	rMess := fmt.Sprintf("health-check request from %s (%s)", clientIP(r), r.Referer())
 	// Perform self-test
 	if err := s.healthCheck(); err != nil {
 		// report error
@@ -219,7 +354,9 @@ func (s *serviceHandler) healthcheck(w http.ResponseWriter, r *http.Request) {
 			"Health check page",
 			version,
 			atomic.LoadInt32(&s.attempts),
-			s.config.Timeout))
+			s.conf().Timeout,
+			s.mode(r),
+			s.webhooks.dropped.Load()))
 	}
 }
 
@@ -231,7 +368,10 @@ func (s *serviceHandler) healthCheck() error {
 	// 3. request to expire the token (received in the first request)
 
 	// long URL for sef-check redirect
-	url := s.config.ShortDomain + "/favicon.ico"
+	url := s.healthCheckURL()
+
+	// HTTP client for self-check requests
+	client := s.client()
 
 	var (
 		// short URL request's replay parameters
@@ -243,18 +383,18 @@ func (s *serviceHandler) healthCheck() error {
 	)
 
 	// self-test part 1: get short URL
-	if s.config.Mode&disableShortener != 0 {
+	if hostPort, ok := s.listenerWith(disableShortener); !ok {
 		// use tokenDB interface as web-interface is locked in this service mode
-		sToken, err := s.generateToken(url, 1)
+		sToken, err := s.generateToken(Link{URL: url}, 1)
 		if err != nil {
 			return fmt.Errorf("new token creation error: %w", err)
 		}
 		// store results
 		repl.Token = sToken
-		repl.URL = s.config.ShortDomain + "/" + repl.Token
+		repl.URL = s.shortURL(repl.Token)
 	} else {
 		// make the HTTP request for new token
-		resp, err := http.Post("http://"+s.config.ListenHostPort+"/api/v1/token", "application/json",
+		resp, err := client.Post(s.scheme()+"://"+hostPort+"/api/v1/token", "application/json",
 			strings.NewReader(`{"url": "`+url+`","exp": 1}`))
 		if err != nil {
 			return fmt.Errorf("new token request error: %w", err)
@@ -285,16 +425,18 @@ func (s *serviceHandler) healthCheck() error {
 
 	// self-test part 2: check redirect
 	rURL := "" // variable to store redirect URL
-	if s.config.Mode&disableRedirect != 0 {
+	if s.conf().Mode&disableRedirect != 0 {
 		// use tokenDB interface as web-interface is locked in this service mode
-		rURL, err = s.tokenDB.Get(repl.Token)
+		var link Link
+		link, err = s.getLink(repl.Token)
 		if err != nil {
 			return fmt.Errorf("URL receiving error: %w", err)
 		}
+		rURL = link.URL
 
 	} else {
 		// try to make the HTTP request for redirect by short URL
-		resp2, err := http.Get("http://" + repl.URL)
+		resp2, err := client.Get(s.scheme() + "://" + s.conf().ShortDomain + "/" + repl.Token)
 		if err != nil {
 			return fmt.Errorf("redirect request error: %w", err)
 		}
@@ -309,19 +451,19 @@ func (s *serviceHandler) healthCheck() error {
 		rURL = resp2.Request.URL.String()
 	}
 	// check redirection URL
-	if rURL != "http://"+url {
+	if rURL != url {
 		return fmt.Errorf("wrong redirection URL: expected %s, received %v", url, rURL)
 	}
 
 	// self-test part 3: make received token as expired
-	if s.config.Mode&disableExpire != 0 {
+	if hostPort, ok := s.listenerWith(disableExpire); !ok {
 		// use tokenDB interface as web-interface is locked in this service mode
 		if err := s.tokenDB.Expire(repl.Token, -1); err != nil {
 			return fmt.Errorf("expire request error: %w", err)
 		}
 	} else {
 		// make the HTTP request to expire token
-		resp3, err := http.Post("http://"+s.config.ListenHostPort+"/api/v1/expire", "application/json",
+		resp3, err := client.Post(s.scheme()+"://"+hostPort+"/api/v1/expire", "application/json",
 			strings.NewReader(`{"token": "`+repl.Token+`","exp":-1}`))
 		if err != nil {
 			return fmt.Errorf("expire request error: %w", err)
@@ -341,13 +483,12 @@ curl -i -v http://localhost:8080/<token>
 */
 
 // Redirect handles redirection to URL that was stored for the specified token
-func (s *serviceHandler) redirect(w http.ResponseWriter, r *http.Request) {
+func (s *serviceHandler) redirect(w http.ResponseWriter, r *http.Request, sToken, suffix string, preview bool) {
 
-	sToken := r.URL.Path[1:] // GET and POST always contain at least "/" in URL
-	rMess := fmt.Sprintf("redirect request from %s (%s), token: %s", r.RemoteAddr, r.Referer(), sToken)
+	rMess := fmt.Sprintf("redirect request from %s (%s), token: %s", clientIP(r), r.Referer(), sToken)
 
 	// check that service mode allows this request
-	if s.config.Mode&disableRedirect != 0 {
+	if s.mode(r)&disableRedirect != 0 {
 		log.Printf("%s: this request is disabled by current service mode\n", rMess)
 		// send 404 response
 		http.NotFound(w, r)
@@ -355,31 +496,267 @@ func (s *serviceHandler) redirect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check the token
-	if err := s.validateToken(sToken); err != nil {
+	if err := s.validateToken(sToken, s.mode(r)); err != nil {
 		log.Printf("%s: incorrect token: %v\n", rMess, err)
 		http.NotFound(w, r)
 		return
 	}
 
-	// get the long URL
-	longURL, err := s.tokenDB.Get(sToken)
+	// get the link
+	link, err := s.getLink(sToken)
 	if err != nil {
-		log.Printf("%s: token was not found\n", rMess)
+		// redirect to fallback URL when the token tombstone is found
+		if fallback, e := s.tokenDB.GetFallback(sToken); e == nil {
+			if fallback = cmp.Or(fallback, s.conf().FallbackURL); fallback != "" && s.recheckDomain(rMess, fallback) {
+				log.Printf("%s: token was expired, redirected to fallback URL %s\n", rMess, fallback)
+				http.Redirect(w, r, fallback, http.StatusFound)
+				return
+			}
+		}
+		log.Printf("%s: token was not found: %v\n", rMess, err)
 		// send 404 response
 		http.NotFound(w, r)
 		return
 	}
 
+	// make the redirect URL
+	var variant string
+	link.URL, variant = link.route(r, s.clicks.geoIP)
+	if suffix != "" && !link.PassPath {
+		log.Printf("%s: path suffix is not passed by the link: %s\n", rMess, suffix)
+		http.NotFound(w, r)
+		return
+	}
+	target, err := link.target(suffix, r.URL.RawQuery)
+	if err != nil {
+		log.Printf("%s: %v\n", rMess, err)
+		http.NotFound(w, r)
+		return
+	}
+	// the link could be created before its destination domain was blocked
+	if !s.recheckDomain(rMess, target) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// check the link activation time
+	if link.pending() {
+		log.Printf("%s: link is not active until %s\n", rMess, link.NotBefore.Format(time.RFC3339))
+		s.linkPage(w, r, http.StatusNotFound, s.conf().PendingLinkPage, "")
+		return
+	}
+
+	// use the link redirect status code or the default one
+	code := cmp.Or(link.Redirect, s.conf().RedirectCode)
+	getRequest := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	// check the password of protected link
+	if link.PasswordHash != "" {
+		if !s.checkPassword(w, r, rMess, sToken, link) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			// the password form submit is redirected as usual GET request
+			code = http.StatusFound
+		}
+	} else if !getRequest && code != http.StatusTemporaryRedirect && code != http.StatusPermanentRedirect {
+		// only 307 and 308 redirects preserve the request method
+		log.Printf("%s: %s request by link that doesn't preserve the request method\n", rMess, r.Method)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the requested preview is shown before any click counting, its continue link is the short URL itself
+	if preview && getRequest {
+		shortURL := "/" + sToken
+		if suffix != "" {
+			shortURL += "/" + suffix
+		}
+		if r.URL.RawQuery != "" {
+			shortURL += "?" + r.URL.RawQuery
+		}
+		log.Printf("%s: preview of %s is shown\n", rMess, target)
+		s.preview(w, sToken, link, target, shortURL)
+		return
+	}
+
+	bot := isBot(r, s.conf().BotPatterns)
+
+	// consume the click of click limited link, link-preview fetchers and mail scanners are redirected without
+	// using up the link (until it is used up)
+	if link.MaxClicks > 0 {
+		ok, err := s.tokenDB.Use(sToken, link.MaxClicks, !bot)
+		if err != nil {
+			log.Printf("%s: click limit checking error: %v\n", rMess, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			log.Printf("%s: link is already used\n", rMess)
+			s.linkPage(w, r, http.StatusGone, s.conf().UsedLinkPage, usedLinkPage)
+			return
+		}
+	}
+
+	// count the click in background
+	s.clicks.count(sToken, r, bot, variant)
+	s.webhooks.emit(sToken, r, bot, variant)
+	if variant != "" && link.Sticky {
+		stickVariant(w, sToken, variant)
+	}
+	s.feed.publish(liveEvent{eventRedirect, sToken, time.Now(), bot, link.Owner})
+	if bot {
+		rMess += " (bot)"
+	}
+
+	// the link that is always previewed (or the requested preview of protected link after the password check)
+	// shows the preview instead of redirect, its continue link is the long URL
+	if link.Preview || preview {
+		log.Printf("%s: preview of %s is shown\n", rMess, target)
+		s.preview(w, sToken, link, target, target)
+		return
+	}
+
 	// log the request results
-	log.Printf("%s: redirected to %s\n", rMess, longURL)
+	log.Printf("%s: redirected (%d) to %s\n", rMess, code, target)
 
 	// respond by redirect
-	http.Redirect(w, r, longURL, http.StatusFound)
+	http.Redirect(w, r, target, code)
+}
+
+// preview responds by the preview page of the link with the destination and continue link
+func (s *serviceHandler) preview(w http.ResponseWriter, sToken string, link Link, destination, continueURL string) {
+	created := ""
+	if t := s.created(sToken, link); !t.IsZero() {
+		created = "Created: " + t.Format(time.DateOnly) + "<br><br>"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(fmt.Appendf(nil, previewPage, html.EscapeString(cmp.Or(link.Title, "Link preview")),
+		html.EscapeString(destination), created, html.EscapeString(continueURL)))
+}
+
+// created returns the link creation time. It is stored separately from the link, but the links created by the
+// previous service versions can have it in the link record. The zero time is returned when it is not known.
+func (s *serviceHandler) created(sToken string, link Link) time.Time {
+	if !link.Created.IsZero() {
+		return link.Created
+	}
+	created, _ := s.tokenDB.GetCreated(sToken)
+	return created
+}
+
+// checkPassword checks the password posted for protected link, it responds by the password form
+// and returns false when the password is not posted or it is wrong.
+func (s *serviceHandler) checkPassword(w http.ResponseWriter, r *http.Request, rMess, sToken string, link Link) bool {
+	form := func(status int, message string) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(fmt.Appendf(nil, passwordPage, message))
+	}
+	if r.Method != http.MethodPost {
+		log.Printf("%s: password form is sent\n", rMess)
+		form(http.StatusOK, "")
+		return false
+	}
+	config := s.conf()
+	// the attempt is counted as wrong one before the check to make the limit hold for parallel attempts
+	failures, err := s.tokenDB.AddFailure(sToken, time.Minute*time.Duration(config.PasswordWindow))
+	if err != nil {
+		log.Printf("%s: password attempt storing error: %v\n", rMess, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if failures > config.PasswordAttempts {
+		log.Printf("%s: too many wrong password attempts\n", rMess)
+		form(http.StatusTooManyRequests, "Too many wrong attempts, try again later.<br><br>")
+		return false
+	}
+	if !link.checkPassword(r.PostFormValue("password")) {
+		log.Printf("%s: wrong password\n", rMess)
+		form(http.StatusForbidden, "Wrong password.<br><br>")
+		return false
+	}
+	if err := s.tokenDB.CancelFailure(sToken); err != nil {
+		log.Printf("%s: password attempt canceling error: %v\n", rMess, err)
+	}
+	return true
+}
+
+// pageFile is the HTML page read from file. The page is read when the configuration is read, so it is reloaded
+// together with the configuration.
+type pageFile struct {
+	file string // page file name, the page is not set when it is empty
+	page string // page content
+}
+
+// UnmarshalText reads the page from the file
+func (pf *pageFile) UnmarshalText(text []byte) error {
+	page := pageFile{file: strings.TrimSpace(string(text))}
+	if page.file != "" {
+		content, err := os.ReadFile(page.file)
+		if err != nil {
+			return err
+		}
+		page.page = string(content)
+	}
+	*pf = page
+	return nil
+}
+
+// linkPage responds by the custom page or by the default page when the custom one is not set with given status,
+// it responds as NotFound when there is no page at all
+func (s *serviceHandler) linkPage(w http.ResponseWriter, r *http.Request, status int, custom pageFile, page string) {
+	if custom.file != "" {
+		page = custom.page
+	}
+	if page == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(page))
+}
+
+// getLink returns the link stored for token
+func (s *serviceHandler) getLink(sToken string) (Link, error) {
+	value, err := s.tokenDB.Get(sToken)
+	if err != nil {
+		return Link{}, err
+	}
+	return decodeLink(value)
+}
+
+// checkDomains returns *urlError when the domain of any URL is rejected by the domains allowlist or blocklist
+func (s *serviceHandler) checkDomains(urls ...string) error {
+	conf := s.conf()
+	own := (&neturl.URL{Host: conf.ShortDomain}).Hostname()
+	if host, err := normalizeHost(own); err == nil {
+		own = host
+	}
+	for _, url := range urls {
+		if err := checkDomain(url, own, conf.AllowListFile, conf.BlockListFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recheckDomain returns false when the domains are checked on redirect and the domain of URL is rejected
+func (s *serviceHandler) recheckDomain(rMess, url string) bool {
+	if !s.conf().RecheckDomains {
+		return true
+	}
+	if err := s.checkDomains(url); err != nil {
+		log.Printf("%s: redirect to %s is rejected: %v\n", rMess, url, err)
+		return false
+	}
+	return true
 }
 
-func (s *serviceHandler) validateToken(t string) error {
+func (s *serviceHandler) validateToken(t string, mode ServiceMode) error {
 	// check the token length
-	if s.config.Mode&disableLengthCheck == 0 {
+	if mode&disableLengthCheck == 0 {
 		if err := s.shortToken.CheckLength(t); err != nil {
 			return err
 		}
@@ -387,6 +764,125 @@ func (s *serviceHandler) validateToken(t string) error {
 	return s.shortToken.CheckAlphabet(t)
 }
 
+/* test for test env:
+curl -i -v http://localhost:8080/api/v1/token/<token>
+*/
+
+// info returns the token information
+func (s *serviceHandler) info(w http.ResponseWriter, r *http.Request, sToken string) {
+	rMess := fmt.Sprintf("token info request from %s (%s), token: %s", clientIP(r), r.Referer(), sToken)
+
+	// Check that service mode allows this request
+	if s.mode(r)&disableShortener != 0 {
+		log.Printf("%s: this request is disabled by current service mode\n", rMess)
+		// request is not supported: send 404 response
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.validateToken(sToken, s.mode(r)); err != nil {
+		log.Printf("%s: incorrect token: %v\n", rMess, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	link, err := s.getLink(sToken)
+	if err != nil {
+		log.Printf("%s: token was not found: %v\n", rMess, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	clicks, err := s.tokenDB.GetClicks(sToken)
+	if err != nil {
+		log.Printf("%s: clicks statistics receiving error: %v", rMess, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the destinations of protected link are not disclosed without the password
+	longURL, options := link.URL, link.LinkOptions
+	if link.PasswordHash != "" {
+		longURL, options.FallbackURL, options.Routes, options.Variants = "", "", nil, nil
+	}
+
+	// make response body
+	resp, _ := json.Marshal(
+		struct {
+			Token   string `json:"token"`              // token
+			URL     string `json:"url"`                // short URL
+			LongURL string `json:"long_url,omitempty"` // long URL, it is omitted for protected link
+			LinkOptions
+			Pending   bool      `json:"pending,omitempty"`   // true when the link is not active yet
+			Protected bool      `json:"protected,omitempty"` // true when the link is protected by password
+			Created   time.Time `json:"created,omitzero"`    // link creation time
+			Clicks    Clicks    `json:"clicks"`              // clicks statistics
+		}{
+			Token:       sToken,
+			URL:         s.shortURL(sToken),
+			LongURL:     longURL,
+			LinkOptions: options,
+			Pending:     link.pending(),
+			Protected:   link.PasswordHash != "",
+			Created:     s.created(sToken, link),
+			Clicks:      clicks,
+		})
+
+	log.Printf("%s: success\n", rMess)
+
+	w.Write(resp)
+}
+
+/* test for test env:
+curl -i -v "http://localhost:8080/api/v1/token/<token>/stats?from=2024-01-01&granularity=day"
+*/
+
+// stats returns the token clicks statistics for requested period
+func (s *serviceHandler) stats(w http.ResponseWriter, r *http.Request, sToken string) {
+	rMess := fmt.Sprintf("token stats request from %s (%s), token: %s", clientIP(r), r.Referer(), sToken)
+
+	// Check that service mode allows this request
+	if s.mode(r)&disableShortener != 0 {
+		log.Printf("%s: this request is disabled by current service mode\n", rMess)
+		// request is not supported: send 404 response
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.validateToken(sToken, s.mode(r)); err != nil {
+		log.Printf("%s: incorrect token: %v\n", rMess, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	from, to, granularity, err := parseStatsPeriod(r.FormValue("from"), r.FormValue("to"), r.FormValue("granularity"), time.Now())
+	if err != nil {
+		log.Printf("%s: bad request parameters: %v\n", rMess, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.tokenDB.Get(sToken); err != nil {
+		log.Printf("%s: token was not found\n", rMess)
+		http.NotFound(w, r)
+		return
+	}
+
+	stats, err := s.tokenDB.GetStats(sToken)
+	if err != nil {
+		log.Printf("%s: clicks statistics receiving error: %v", rMess, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// make response body
+	resp, _ := json.Marshal(stats.report(sToken, from, to, granularity))
+
+	log.Printf("%s: success\n", rMess)
+
+	w.Write(resp)
+}
+
 /* test for test env:
 curl -v POST -H "Content-Type: application/json" -d '{"url":"<long url>","exp":10}' http://localhost:8080/api/v1/token
 */
@@ -395,10 +891,10 @@ curl -v POST -H "Content-Type: application/json" -d '{"url":"<long url>","exp":1
 func (s *serviceHandler) new(w http.ResponseWriter, r *http.Request, body []byte) {
 	// TODO: check some authorization ???
 
-	rMess := fmt.Sprintf("token request from %s (%s)", r.RemoteAddr, r.Referer())
+	rMess := fmt.Sprintf("token request from %s (%s)", clientIP(r), r.Referer())
 
 	// Check that service mode allows this request
-	if s.config.Mode&disableShortener != 0 {
+	if s.mode(r)&disableShortener != 0 {
 		log.Printf("%s: this request is disabled by current service mode\n", rMess)
 		// request is not supported: send 404 response
 		http.NotFound(w, r)
@@ -407,8 +903,10 @@ func (s *serviceHandler) new(w http.ResponseWriter, r *http.Request, body []byte
 
 	// the request parameters structure
 	var params struct {
-		URL string `json:"url"`           // long URL
-		Exp int    `json:"exp,omitempty"` // Expiration
+		URL      string `json:"url"`                // long URL
+		Exp      int    `json:"exp,omitempty"`      // Expiration
+		Password string `json:"password,omitempty"` // password of protected link
+		LinkOptions
 	}
 
 	// parse body to parameters structure
@@ -418,11 +916,37 @@ func (s *serviceHandler) new(w http.ResponseWriter, r *http.Request, body []byte
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	params.URL, err = normalizeURL(params.URL, s.conf().URLSchemes)
+	if err != nil {
+		rejectURL(w, rMess, err)
+		return
+	}
+	link := Link{URL: params.URL, LinkOptions: params.LinkOptions}
+	if err := link.check(); err != nil {
+		log.Printf("%s: bad request parameters: %v", rMess, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = link.normalize()
+	if err == nil {
+		err = s.checkDomains(link.destinations()...)
+	}
+	if err != nil {
+		rejectURL(w, rMess, err)
+		return
+	}
+	if params.Password != "" {
+		if err := link.setPassword(params.Password); err != nil {
+			log.Printf("%s: bad request parameters: %v", rMess, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 
 	// log received params
 	rMess += fmt.Sprintf(" parameters: '%s', %d", params.URL, params.Exp)
 
-	sToken, err := s.generateToken(params.URL, params.Exp)
+	sToken, err := s.generateToken(link, params.Exp)
 	// handle token generation error
 	if err != nil {
 		log.Printf("%s: token generation error:%s", rMess, body)
@@ -441,7 +965,7 @@ func (s *serviceHandler) new(w http.ResponseWriter, r *http.Request, body []byte
 			URL   string `json:"url"`   // short URL
 		}{
 			Token: sToken,
-			URL:   s.config.ShortDomain + "/" + sToken,
+			URL:   s.shortURL(sToken),
 		})
 
 	// log new token request information
@@ -452,7 +976,7 @@ func (s *serviceHandler) new(w http.ResponseWriter, r *http.Request, body []byte
 }
 
 // generateToken generates token or writes the error in w
-func (s *serviceHandler) generateToken(url string, exp int) (string, error) {
+func (s *serviceHandler) generateToken(link Link, exp int) (string, error) {
 	// Using many attempts to store the new random token dramatically increases maximum amount of
 	// used tokens since:
 	// probability of the failure of n attempts = (probability of failure of single attempt)^n.
@@ -464,14 +988,16 @@ func (s *serviceHandler) generateToken(url string, exp int) (string, error) {
 	var startTime time.Time
 	var err error
 
-	// add reference type if it is missing
-	if !strings.HasPrefix(strings.ToLower(url), "http") {
-		url = "http://" + url
-	}
+	// use the same time-out during whole generation even if configuration is reloaded meanwhile
+	timeout := s.conf().Timeout
+
+	// the creation time is stored separately by database: the links without options are stored as plain URLs
+	// to stay compatible with the service versions that don't support link options
+	value := link.encode()
 
 	// set the default expiration if it is not passed
 	if exp == 0 {
-		exp = s.config.DefaultExp
+		exp = s.conf().DefaultExp
 	}
 
 	// Calculate statistics and report if some dangerous situation appears
@@ -480,15 +1006,15 @@ func (s *serviceHandler) generateToken(url string, exp int) (string, error) {
 		// perform statistical calculation and reporting in another go-routine
 		go func() {
 			if attempt > 0 {
-				MaxAtt := attempt * int64(s.config.Timeout) * 1000000 / elapsedTime.Nanoseconds()
+				MaxAtt := attempt * int64(timeout) * 1000000 / elapsedTime.Nanoseconds()
 				// use atomic to avoid race conditions
 				atomic.StoreInt32(&s.attempts, int32(MaxAtt))
 				// report warnings of some not good measurements
 				if MaxAtt*3/4 < attempt {
-					log.Printf("Warning: Measured %d attempts for %d ns. Calculated %d max attempts per %d ms\n", attempt, elapsedTime, MaxAtt, s.config.Timeout)
+					log.Printf("Warning: Measured %d attempts for %d ns. Calculated %d max attempts per %d ms\n", attempt, elapsedTime, MaxAtt, timeout)
 				}
 				if MaxAtt > 0 && MaxAtt < 10 {
-					log.Printf("Warning: Too low number of attempts: %d per timeout (%d ms)\n", MaxAtt, s.config.Timeout)
+					log.Printf("Warning: Too low number of attempts: %d per timeout (%d ms)\n", MaxAtt, timeout)
 				}
 			}
 		}()
@@ -497,7 +1023,7 @@ func (s *serviceHandler) generateToken(url string, exp int) (string, error) {
 	sToken := ""
 
 	// make time-out chanel
-	stop := time.After(time.Millisecond * time.Duration(s.config.Timeout))
+	stop := time.After(time.Millisecond * time.Duration(timeout))
 
 	// Remember starting time
 	startTime = time.Now()
@@ -514,16 +1040,38 @@ func (s *serviceHandler) generateToken(url string, exp int) (string, error) {
 			// count attempts
 			attempt++
 			// store token in DB
-			ok, err = s.tokenDB.Set(sToken, url, exp)
+			ok, err = s.tokenDB.Set(sToken, value, exp)
 			if err != nil {
 				return "", fmt.Errorf("token storing error: %v", err)
 			}
 		}
 	}
+	if exp > 0 {
+		s.setTombstone(sToken, link, exp)
+	}
+	// health check tokens are not reported
+	if !s.isHealthCheck(link) {
+		s.webhooks.notify(eventCreated, sToken, link.URL, exp)
+		s.feed.publish(liveEvent{eventCreated, sToken, time.Now(), false, link.Owner})
+	}
 
 	return sToken, nil
 }
 
+// setTombstone stores the token tombstone that is kept for configured retention period after the token expiration
+// (exp is the token expiration in days), errors are only logged as tombstone is not critical for the token.
+// The tombstone is stored only when there is a fallback URL to redirect to (the link one or the default one) and
+// it is never stored for health check tokens.
+func (s *serviceHandler) setTombstone(sToken string, link Link, exp int) {
+	conf := s.conf()
+	if conf.FallbackRetention <= 0 || link.FallbackURL == "" && conf.FallbackURL == "" || s.isHealthCheck(link) {
+		return
+	}
+	if err := s.tokenDB.SetFallback(sToken, link.FallbackURL, max(exp, 0)+conf.FallbackRetention); err != nil {
+		log.Printf("tombstone of %s storing error: %v", sToken, err)
+	}
+}
+
 /* test for test env:
 curl -v POST -H "Content-Type: application/json" -d '{"token":"<token>","exp":<exp>}' http://localhost:8080/api/v1/expire
 */
@@ -532,10 +1080,10 @@ curl -v POST -H "Content-Type: application/json" -d '{"token":"<token>","exp":<e
 func (s *serviceHandler) expire(w http.ResponseWriter, r *http.Request, body []byte) {
 	// TODO: check some authorization ???
 
-	rMess := fmt.Sprintf("expire request from %s (%s)", r.RemoteAddr, r.Referer())
+	rMess := fmt.Sprintf("expire request from %s (%s)", clientIP(r), r.Referer())
 
 	// Check that service mode allows this request
-	if s.config.Mode&disableExpire != 0 {
+	if s.mode(r)&disableExpire != 0 {
 		log.Printf("%s: this request is disabled by current service mode\n", rMess)
 		// request is not supported: send 404 response
 		http.NotFound(w, r)
@@ -556,19 +1104,33 @@ func (s *serviceHandler) expire(w http.ResponseWriter, r *http.Request, body []b
 		return
 	}
 
-	if err := s.validateToken(params.Token); err != nil {
+	if err := s.validateToken(params.Token, s.mode(r)); err != nil {
 		log.Printf("%s: incorrect token: %v\n", rMess, err)
 		http.NotFound(w, r)
 		return
 	}
 
-	// update token expiration
-	err = s.tokenDB.Expire(params.Token, params.Exp)
+	// get the link to keep its fallback URL in tombstone
+	link, err := s.getLink(params.Token)
+	if err == nil {
+		// update token expiration
+		err = s.tokenDB.Expire(params.Token, params.Exp)
+	}
 	if err != nil {
 		log.Printf("%s: updating token expiration error: %s", rMess, err)
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
+	s.setTombstone(params.Token, link, params.Exp)
+
+	// notify webhooks (but not about health check tokens): zero expiration expires token immediately
+	switch {
+	case s.isHealthCheck(link):
+	case params.Exp > 0:
+		s.webhooks.notify(eventUpdated, params.Token, "", params.Exp)
+	default:
+		s.webhooks.notify(eventExpired, params.Token, "", 0)
+	}
 
 	// log request results
 	log.Printf("%s: token expiration of %s has set to %d\n", rMess, params.Token, params.Exp)
@@ -577,22 +1139,473 @@ func (s *serviceHandler) expire(w http.ResponseWriter, r *http.Request, body []b
 	w.WriteHeader(http.StatusOK)
 }
 
+/* test for test env:
+curl -v POST -H "Content-Type: application/json" -d '{"token":"<token>","url":"<long url>"}' http://localhost:8080/api/v1/update
+*/
+
+// update changes the long URL of token
+func (s *serviceHandler) update(w http.ResponseWriter, r *http.Request, body []byte) {
+	rMess := fmt.Sprintf("update request from %s (%s)", clientIP(r), r.Referer())
+
+	// Check that service mode allows this request
+	if s.mode(r)&disableExpire != 0 {
+		log.Printf("%s: this request is disabled by current service mode\n", rMess)
+		// request is not supported: send 404 response
+		http.NotFound(w, r)
+		return
+	}
+
+	// make the request parameters structure
+	var params struct {
+		Token string `json:"token"` // Token of short URL token
+		URL   string `json:"url"`   // new long URL
+	}
+
+	// parse JSON from body to parameters structure
+	err := json.Unmarshal(body, &params)
+	if err != nil || params.Token == "" || params.URL == "" {
+		log.Printf("%s: bad request parameters:%s", rMess, body)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.validateToken(params.Token, s.mode(r)); err != nil {
+		log.Printf("%s: incorrect token: %v\n", rMess, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	params.URL, err = normalizeURL(params.URL, s.conf().URLSchemes)
+	if err == nil {
+		err = s.checkDomains(params.URL)
+	}
+	if err != nil {
+		rejectURL(w, rMess, err)
+		return
+	}
+
+	// keep the link options
+	link, err := s.getLink(params.Token)
+	if err == nil {
+		link.URL = params.URL
+		err = s.tokenDB.Update(params.Token, link.encode())
+	}
+	if err != nil {
+		log.Printf("%s: updating token error: %s", rMess, err)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.webhooks.notify(eventUpdated, params.Token, params.URL, 0)
+
+	// log request results
+	log.Printf("%s: long URL of %s has changed to %s\n", rMess, params.Token, params.URL)
+
+	// send response
+	w.WriteHeader(http.StatusOK)
+}
+
+/* test for test env:
+curl -v POST -H "Content-Type: application/json" -d '{"token":"<token>"}' http://localhost:8080/api/v1/delete
+*/
+
+// delete removes the token
+func (s *serviceHandler) delete(w http.ResponseWriter, r *http.Request, body []byte) {
+	rMess := fmt.Sprintf("delete request from %s (%s)", clientIP(r), r.Referer())
+
+	// Check that service mode allows this request
+	if s.mode(r)&disableExpire != 0 {
+		log.Printf("%s: this request is disabled by current service mode\n", rMess)
+		// request is not supported: send 404 response
+		http.NotFound(w, r)
+		return
+	}
+
+	// make the request parameters structure
+	var params struct {
+		Token string `json:"token"` // Token of short URL token
+	}
+
+	// parse JSON from body to parameters structure
+	err := json.Unmarshal(body, &params)
+	if err != nil || params.Token == "" {
+		log.Printf("%s: bad request parameters:%s", rMess, body)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.validateToken(params.Token, s.mode(r)); err != nil {
+		log.Printf("%s: incorrect token: %v\n", rMess, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	if err = s.tokenDB.Delete(params.Token); err != nil {
+		log.Printf("%s: deleting token error: %s", rMess, err)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.webhooks.notify(eventDeleted, params.Token, "", 0)
+
+	// log request results
+	log.Printf("%s: token %s deleted\n", rMess, params.Token)
+
+	// send response
+	w.WriteHeader(http.StatusOK)
+}
+
+// conf returns current service configuration
+func (s *serviceHandler) conf() *Config {
+	return s.config.Load()
+}
+
+// reload re-reads the configuration and replaces the current one when only runtime options are changed
+func (s *serviceHandler) reload() error {
+	current := s.conf()
+	config, err := readConfig(current.args...)
+	if err != nil {
+		return err
+	}
+	if err := checkRuntimeChanges(current, config); err != nil {
+		return err
+	}
+	s.config.Store(config)
+	log.Printf("configuration reloaded: Mode: %s, InternalMode: %s, DefaultExp: %d, Timeout: %d, ShortDomain: %s",
+		config.Mode, config.InternalMode, config.DefaultExp, config.Timeout, config.ShortDomain)
+	return nil
+}
+
+/* test for test env:
+curl -v POST -H "Authorization: Bearer <admin key>" http://localhost:8080/api/v1/admin/reload
+*/
+
+// reloadRequest handles the request for configuration reload
+func (s *serviceHandler) reloadRequest(w http.ResponseWriter, r *http.Request) {
+	rMess := fmt.Sprintf("configuration reload request from %s (%s)", clientIP(r), r.Referer())
+	if !s.checkAdmin(w, r, rMess) {
+		return
+	}
+	if err := s.reload(); err != nil {
+		log.Printf("%s: %v", rMess, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.Printf("%s: success", rMess)
+	w.WriteHeader(http.StatusOK)
+}
+
+/* test for test env:
+curl -N -H "Authorization: Bearer <admin key>" http://localhost:8080/api/v1/events?token=<token>
+*/
+
+// events streams live events (redirects and token creations) as Server-Sent Events
+func (s *serviceHandler) events(w http.ResponseWriter, r *http.Request) {
+	rMess := fmt.Sprintf("events feed request from %s (%s)", clientIP(r), r.Referer())
+	if !s.checkAdmin(w, r, rMess) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("%s: streaming is not supported by connection", rMess)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	token := r.FormValue("token")
+	if token != "" {
+		rMess += ", token: " + token
+	}
+	owner := r.FormValue("owner")
+	if owner != "" {
+		rMess += ", owner: " + owner
+	}
+
+	sub := s.feed.subscribe(token, owner)
+	defer s.feed.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Printf("%s: streaming started", rMess)
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case e := <-sub.events:
+			if dropped := s.feed.takeDropped(sub); dropped > 0 {
+				// let the slow consumer know that it has missed some events
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", dropped)
+			}
+			if err == nil {
+				data, _ := json.Marshal(e)
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			}
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			log.Printf("%s: streaming finished by client", rMess)
+			return
+		case <-s.feed.done:
+			log.Printf("%s: streaming finished by service stop", rMess)
+			return
+		}
+		if err != nil {
+			log.Printf("%s: streaming error: %v", rMess, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// checkAdmin checks the admin key of request and writes the error response when the check is not passed
+func (s *serviceHandler) checkAdmin(w http.ResponseWriter, r *http.Request, rMess string) bool {
+	if s.mode(r)&disableAdmin != 0 {
+		log.Printf("%s: this request is disabled by current service mode\n", rMess)
+		http.NotFound(w, r)
+		return false
+	}
+	adminKey := s.conf().AdminKey
+	if adminKey == "" {
+		log.Printf("%s: admin requests are disabled as admin key is not configured", rMess)
+		http.NotFound(w, r)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+adminKey)) != 1 {
+		log.Printf("%s: wrong admin key", rMess)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// modeKey is the request context key for the service mode of listener that received the request
+type modeKey struct{}
+
+// withMode returns the handler that serves requests in the service mode returned by mode function
+func (s *serviceHandler) withMode(mode func() ServiceMode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), modeKey{}, mode())))
+	})
+}
+
+// mode returns the service mode for the request
+func (s *serviceHandler) mode(r *http.Request) ServiceMode {
+	if mode, ok := r.Context().Value(modeKey{}).(ServiceMode); ok {
+		return mode
+	}
+	return s.conf().Mode
+}
+
+// listenerWith returns host:port of the listener where the feature is enabled
+func (s *serviceHandler) listenerWith(feature ServiceMode) (string, bool) {
+	config := s.conf()
+	if config.Mode&feature == 0 {
+		return config.ListenHostPort, true
+	}
+	if config.InternalHostPort != "" && config.InternalMode&feature == 0 {
+		return config.InternalHostPort, true
+	}
+	return "", false
+}
+
+// healthCheckURL returns the long URL of health check tokens. It is compared with the redirect location, so it is
+// normalized as it is stored.
+func (s *serviceHandler) healthCheckURL() string {
+	url := s.scheme() + "://" + s.conf().ShortDomain + "/favicon.ico"
+	if normalized, err := normalizeURL(url, s.conf().URLSchemes); err == nil {
+		return normalized
+	}
+	return url
+}
+
+// isHealthCheck returns true when the link is made by health check: it is the plain link to health check URL
+func (s *serviceHandler) isHealthCheck(link Link) bool {
+	return link.URL == s.healthCheckURL() && link.encode() == link.URL
+}
+
+// shortURL returns the short URL for given token
+func (s *serviceHandler) shortURL(sToken string) string {
+	sURL := s.conf().ShortDomain + "/" + sToken
+	if s.certs != nil {
+		// the scheme is explicit as the short URL is served only via HTTPS
+		sURL = "https://" + sURL
+	}
+	return sURL
+}
+
+// scheme returns the scheme of service URLs
+func (s *serviceHandler) scheme() string {
+	if s.certs != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// client returns the HTTP client for self-check requests
+func (s *serviceHandler) client() *http.Client {
+	if s.certs == nil {
+		return http.DefaultClient
+	}
+	// trust the current service certificate even if it is self-signed
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if leaf := s.certs.leaf(); leaf != nil {
+		roots.AddCert(leaf)
+	}
+	// self-check requests are sent to ListenHostPort, but the certificate is issued for ShortDomain
+	host, _, err := net.SplitHostPort(s.conf().ShortDomain)
+	if err != nil {
+		host = s.conf().ShortDomain
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: host},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// httpsRedirect redirects HTTP requests to the same URL via HTTPS
+func (s *serviceHandler) httpsRedirect(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, err := net.SplitHostPort(s.conf().ListenHostPort); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	log.Printf("HTTP request from %s redirected to %s", s.conf().TrustedProxies.resolve(r, s.conf().ProxyHeader), target)
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
 // Start returns started server
 func (s *serviceHandler) start() error {
 
-	log.Println("starting server at", s.config.ListenHostPort)
+	log.Println("starting server at", s.conf().ListenHostPort)
+	log.Println("service mode:", s.conf().Mode)
+
+	if s.certs != nil {
+		if err := s.certs.load(); err != nil {
+			return err
+		}
+		go s.certs.watch(s.ctx, certCheckInterval)
+	}
+
+	if s.internal != nil {
+		log.Println("starting internal server at", s.conf().InternalHostPort)
+		log.Println("internal service mode:", s.conf().InternalMode)
+		if s.conf().Mode&disableShortener == 0 {
+			// the defaults keep the API public, the internal listener only adds the admin requests
+			log.Println("Warning: shortener API is served by public listener too, set its service mode to redirect-only to serve the API by internal listener only")
+		}
+		go func() {
+			var err error
+			if s.certs == nil {
+				err = s.internal.ListenAndServe()
+			} else {
+				err = s.internal.ListenAndServeTLS("", "")
+			}
+			if err != http.ErrServerClosed {
+				log.Printf("internal server error: %v", err)
+			}
+		}()
+	}
+
+	if s.certs == nil {
+		return s.server.ListenAndServe()
+	}
 
-	return s.server.ListenAndServe()
+	if s.httpServer != nil {
+		log.Println("starting HTTP to HTTPS redirect server at", s.conf().HTTPHostPort)
+		go func() {
+			if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("HTTP to HTTPS redirect server error: %v", err)
+			}
+		}()
+	}
+
+	return s.server.ListenAndServeTLS("", "")
 }
 
 // Stop performs graceful shutdown of server and database interfaces
 func (s *serviceHandler) stop() {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+	// live events streams never become idle, so they have to be finished before the servers shutdown
+	s.feed.close()
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			log.Printf("HTTP to HTTPS redirect server shutdown error: %v", err)
+		}
+	}
+	if s.internal != nil {
+		if err := s.internal.Shutdown(ctx); err != nil {
+			log.Printf("internal server shutdown error: %v", err)
+		}
+	}
 	err := s.server.Shutdown(ctx)
 	if err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
 	}
+	// stop background routines and wait for the last clicks storing and events delivery
+	s.cancel()
+	s.clicks.wait()
+	s.webhooks.wait()
+	if err := s.clicks.geoIP.close(); err != nil {
+		log.Printf("GeoIP database closing error: %v", err)
+	}
+}
+
+// watchExpired notifies about the tokens expired by TTL that are reported by database keyspace notifications
+func (s *serviceHandler) watchExpired() {
+	if err := s.tokenDB.WatchExpired(s.ctx, s.expired); err != nil {
+		log.Printf("expired tokens watching error: %v (expired tokens are found by sweeping only)", err)
+	}
+}
+
+// expired notifies about the token expired by TTL, the token is claimed in database to notify about it once by
+// all the service instances
+func (s *serviceHandler) expired(sToken string) {
+	claimed, err := s.tokenDB.ClaimExpired(sToken)
+	if err != nil {
+		log.Printf("expired token %s claiming error: %v", sToken, err)
+		return
+	}
+	if claimed {
+		s.webhooks.notify(eventExpired, sToken, "", 0)
+	}
+}
+
+// sweepExpired finds the tokens expired by TTL every interval until the service is stopped. It notifies about
+// the tokens that were not reported by keyspace notifications: the notifications are not available or the
+// tokens expired while the service was not running.
+func (s *serviceHandler) sweepExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				tokens, err := s.tokenDB.SweepExpired(expiredSweepBatch)
+				for _, sToken := range tokens {
+					s.webhooks.notify(eventExpired, sToken, "", 0)
+				}
+				if err != nil {
+					log.Printf("expired tokens sweeping error: %v", err)
+				}
+				if err != nil || len(tokens) < expiredSweepBatch {
+					break
+				}
+			}
+		}
+	}
 }
 
 // NewHandler returns new service handler
@@ -602,10 +1615,28 @@ func NewHandler(config *Config, tokenDB TokenDB, shortToken ShortToken) ServiceH
 	handler := &serviceHandler{
 		tokenDB:    tokenDB,
 		shortToken: shortToken,
-		config:     config,
 		server:     nil,
 		attempts:   0,
 	}
+	handler.config.Store(config)
+	handler.ctx, handler.cancel = context.WithCancel(context.Background())
+
+	// start clicks counting
+	geo, err := openGeoIP(config.GeoIPFile)
+	if err != nil {
+		log.Printf("%v: clicks statistics by countries is not collected", err)
+	}
+	handler.clicks = newClickCounter(tokenDB, geo)
+	go handler.clicks.run(handler.ctx, clicksFlushInterval)
+
+	// start click events delivery
+	handler.webhooks = newWebhookDispatcher(handler.conf)
+	go handler.webhooks.run(handler.ctx, webhookFlushInterval)
+
+	// notify about tokens expired by TTL (the lifecycle webhooks can be set by configuration reload, so the
+	// expired tokens are always watched)
+	go handler.watchExpired()
+	go handler.sweepExpired(expiredSweepInterval)
 
 	// create server
 	handler.server = &http.Server{
@@ -613,5 +1644,31 @@ func NewHandler(config *Config, tokenDB TokenDB, shortToken ShortToken) ServiceH
 		Handler: handler,
 	}
 
+	// live events streams are finished on stop
+	handler.feed = newEventFeed()
+
+	if config.InternalHostPort != "" {
+		// internal listener serves requests in its own service mode
+		handler.internal = &http.Server{
+			Addr:    config.InternalHostPort,
+			Handler: handler.withMode(func() ServiceMode { return handler.conf().InternalMode }),
+		}
+	}
+
+	if config.TLSCertFile != "" {
+		// serve HTTPS with reloadable certificate
+		handler.certs = newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+		handler.server.TLSConfig = &tls.Config{GetCertificate: handler.certs.GetCertificate}
+		if handler.internal != nil {
+			handler.internal.TLSConfig = handler.server.TLSConfig
+		}
+		if config.HTTPHostPort != "" {
+			handler.httpServer = &http.Server{
+				Addr:    config.HTTPHostPort,
+				Handler: http.HandlerFunc(handler.httpsRedirect),
+			}
+		}
+	}
+
 	return handler
 }
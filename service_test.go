@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,6 +35,8 @@ func Test10Service03CheckHealthCheck(t *testing.T) {
 		ListenHostPort: "localhost:8080",
 		ShortDomain:    "localhost:8080",
 		Timeout:        500,
+		RedirectCode:   http.StatusFound,
+		URLSchemes:     []string{"http", "https"},
 		TokenLength:    tokenLength,
 	}
 
@@ -121,6 +132,454 @@ func checkStart(url string) func() bool {
 	}
 }
 
+// noRedirectClient is HTTP client that doesn't follow redirects
+var noRedirectClient = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+// browserGet makes GET request with browser user agent (requests of Go HTTP client are counted as bot hits)
+func browserGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0")
+	return http.DefaultClient.Do(req)
+}
+
+// postJSON makes POST request with JSON body and returns the response status code and body
+func postJSON(t *testing.T, url, body string) (int, string) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(buf)
+}
+
+// newToken requests new short token and returns the response status code and the token
+func newToken(t *testing.T, hostPort, body string) (int, string) {
+	status, buf := postJSON(t, "http://"+hostPort+"/api/v1/token", body)
+	var repl struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal([]byte(buf), &repl)
+	return status, repl.Token
+}
+
+// redirectGet makes GET request with user agent (Go HTTP client one when it is empty) without following
+// redirects and returns the response status code, location and body
+func redirectGet(t *testing.T, url, userAgent string) (int, string, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := noRedirectClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, resp.Header.Get("Location"), string(buf)
+}
+
+// try to start service with HTTPS and HTTP to HTTPS redirect
+func Test10Service04TLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), 1)
+	conf := Config{
+		ListenHostPort: "localhost:8443",
+		ShortDomain:    "localhost:8443",
+		Timeout:        500,
+		RedirectCode:   http.StatusFound,
+		URLSchemes:     []string{"http", "https"},
+		TokenLength:    6,
+		TLSCertFile:    certFile,
+		TLSKeyFile:     keyFile,
+		HTTPHostPort:   "localhost:8081",
+	}
+	db := newMockDB()
+	db.getFunc = func(string) (string, error) { return "https://localhost:8443/favicon.ico", nil }
+
+	testHandler := NewHandler(&conf, db, NewShortToken(conf.TokenLength))
+	go func() {
+		require.Equal(t, http.ErrServerClosed, testHandler.start())
+	}()
+	defer testHandler.stop()
+	h := testHandler.(*serviceHandler)
+	require.Eventually(t, func() bool { return h.certs.leaf() != nil }, time.Second, 10*time.Millisecond)
+	client := h.client()
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://localhost:8081/")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, testHandler.healthCheck())
+
+	t.Run("short URL has https scheme", func(t *testing.T) {
+		resp, err := client.Post("https://localhost:8443/api/v1/token", "application/json",
+			strings.NewReader(`{"url": "https://localhost:8443/favicon.ico"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buf), `"url":"https://localhost:8443/`)
+	})
+
+	t.Run("HTTP request is redirected to HTTPS", func(t *testing.T) {
+		noRedirect := *client
+		noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		resp, err := noRedirect.Get("http://localhost:8081/ui/generate?s=x")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		require.Equal(t, "https://localhost:8443/ui/generate?s=x", resp.Header.Get("Location"))
+	})
+}
+
+// try to reload configuration via admin request
+func Test10Service06Reload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(conf string) {
+		require.NoError(t, os.WriteFile(name, []byte("redisAddrs: localhost:6379\n"+conf), 0600))
+	}
+	writeConfig("")
+	conf, err := readConfig("-config", name)
+	require.NoError(t, err)
+
+	testHandler := NewHandler(conf, newMockDB(), NewShortToken(conf.TokenLength))
+	go func() {
+		require.Equal(t, http.ErrServerClosed, testHandler.start())
+	}()
+	defer testHandler.stop()
+	require.Eventually(t, checkStart("http://localhost:8080/"), time.Second, 10*time.Millisecond)
+
+	reload := func(key string) int {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/api/v1/admin/reload", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	h := testHandler.(*serviceHandler)
+
+	t.Run("admin key is not configured", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, reload(""))
+	})
+
+	t.Run("reload by signal handler", func(t *testing.T) {
+		writeConfig("adminKey: secret\nmode: 4\ndefaultExp: 3\n")
+		require.NoError(t, testHandler.reload())
+		require.Equal(t, disableExpire, h.conf().Mode)
+		require.Equal(t, 3, h.conf().DefaultExp)
+	})
+
+	t.Run("wrong admin key", func(t *testing.T) {
+		require.Equal(t, http.StatusUnauthorized, reload("wrong"))
+	})
+
+	t.Run("reload by request", func(t *testing.T) {
+		writeConfig("adminKey: secret\nshortDomain: some.domain\n")
+		outF := catchLog()
+		status := reload("secret")
+		out := outF()
+		require.Equal(t, http.StatusOK, status)
+		// the admin key is not logged
+		require.Contains(t, out, "access from:")
+		require.Contains(t, out, "Authorization:[[redacted]]")
+		require.NotContains(t, out, "secret")
+		require.Equal(t, ServiceMode(0), h.conf().Mode)
+		require.Equal(t, "some.domain", h.conf().ShortDomain)
+	})
+
+	t.Run("not runtime option change is rejected", func(t *testing.T) {
+		writeConfig("adminKey: secret\ntokenLength: 8\nmode: 1\n")
+		require.Equal(t, http.StatusBadRequest, reload("secret"))
+		require.EqualError(t, testHandler.reload(), "config reload rejected: TokenLength can't be changed at runtime")
+		require.Equal(t, 6, h.conf().TokenLength)
+		require.Equal(t, ServiceMode(0), h.conf().Mode)
+	})
+
+	t.Run("wrong configuration is rejected", func(t *testing.T) {
+		writeConfig("adminKey: secret\nmode: z\n")
+		require.Equal(t, http.StatusBadRequest, reload("secret"))
+		require.Equal(t, "some.domain", h.conf().ShortDomain)
+	})
+}
+
+// try to serve redirects and API on separate listeners
+func Test10Service07Listeners(t *testing.T) {
+	conf := Config{
+		ListenHostPort:   "localhost:8080",
+		ShortDomain:      "localhost:8080",
+		Timeout:          500,
+		RedirectCode:     http.StatusFound,
+		URLSchemes:       []string{"http", "https"},
+		TokenLength:      6,
+		Mode:             disableShortener | disableExpire | disableUI | disableAdmin,
+		AdminKey:         "secret",
+		InternalHostPort: "localhost:8082",
+		InternalMode:     disableRedirect,
+	}
+	testHandler := NewHandler(&conf, newMockDB(), NewShortToken(conf.TokenLength))
+	go func() {
+		require.Equal(t, http.ErrServerClosed, testHandler.start())
+	}()
+	defer testHandler.stop()
+	require.Eventually(t, checkStart("http://localhost:8082/"), time.Second, 10*time.Millisecond)
+	require.Eventually(t, checkStart("http://localhost:8080/"), time.Second, 10*time.Millisecond)
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	post := func(url, body string) int {
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	get := func(url string) int {
+		resp, err := noRedirect.Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, c := range []struct {
+		name     string
+		status   int
+		expected int
+	}{
+		{"public new token", post("http://localhost:8080/api/v1/token", `{"url":"some.url"}`), http.StatusNotFound},
+		{"internal new token", post("http://localhost:8082/api/v1/token", `{"url":"some.url"}`), http.StatusOK},
+		{"public expire", post("http://localhost:8080/api/v1/expire", `{"token":"AAAAAA"}`), http.StatusNotFound},
+		{"internal expire", post("http://localhost:8082/api/v1/expire", `{"token":"AAAAAA"}`), http.StatusOK},
+		{"public reload", post("http://localhost:8080/api/v1/admin/reload", ``), http.StatusNotFound},
+		{"public UI", get("http://localhost:8080/ui/generate"), http.StatusNotFound},
+		{"internal UI", get("http://localhost:8082/ui/generate"), http.StatusOK},
+		{"public redirect", get("http://localhost:8080/AAAAAA"), http.StatusFound},
+		{"internal redirect", get("http://localhost:8082/AAAAAA"), http.StatusNotFound},
+	} {
+		require.Equal(t, c.expected, c.status, c.name)
+	}
+
+	// health-check uses internal listener for requests disabled on public one
+	require.NoError(t, testHandler.healthCheck())
+
+	// the default public mode keeps the API public: it is warned on start
+	for _, mode := range []ServiceMode{conf.Mode, 0} {
+		conf := conf
+		conf.ListenHostPort, conf.InternalHostPort, conf.Mode = "localhost:8083", "localhost:8084", mode
+		logs := catchLog()
+		h := NewHandler(&conf, newMockDB(), NewShortToken(conf.TokenLength))
+		go h.start()
+		require.Eventually(t, checkStart("http://localhost:8084/"), time.Second, 10*time.Millisecond)
+		h.stop()
+		if mode == 0 {
+			require.Contains(t, logs(), "Warning: shortener API is served by public listener too")
+		} else {
+			require.NotContains(t, logs(), "Warning")
+		}
+	}
+}
+
+func Test10Service08Lifecycle(t *testing.T) {
+	mu := sync.Mutex{}
+	received := map[string][]string{} // events by webhook path
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e lifecycleEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		mu.Lock()
+		defer mu.Unlock()
+		received[r.URL.Path] = append(received[r.URL.Path], e.Event+" "+e.Token+" "+e.LongURL)
+	}))
+	defer srv.Close()
+	events := func() map[string][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(received)
+	}
+
+	conf := Config{
+		ListenHostPort: "localhost:8080",
+		ShortDomain:    "localhost:8080",
+		Timeout:        500,
+		RedirectCode:   http.StatusFound,
+		URLSchemes:     []string{"http", "https"},
+		TokenLength:    6,
+		DefaultExp:     1,
+	}
+	db := newMockDB()
+	watched := make(chan func(string), 1)
+	db.watchFunc = func(ctx context.Context, expired func(string)) error {
+		watched <- expired
+		<-ctx.Done()
+		return nil
+	}
+	// only the first claim of expired token is successful
+	claimed := sync.Map{}
+	db.claimFunc = func(sToken string) (bool, error) {
+		_, loaded := claimed.LoadOrStore(sToken, true)
+		return !loaded, nil
+	}
+	swept := make(chan []string, 1)
+	swept <- []string{"DDDDDD"}
+	db.sweepFunc = func(_ int) ([]string, error) {
+		select {
+		case tokens := <-swept:
+			return tokens, nil
+		default:
+			return nil, nil
+		}
+	}
+	db.getFunc = func(sToken string) (string, error) {
+		if sToken == "AAAAAA" {
+			return "http://other.url", nil
+		}
+		// health check token
+		return "http://localhost:8080/favicon.ico", nil
+	}
+	db.updateFunc = func(sToken, _ string) error {
+		if sToken != "AAAAAA" {
+			return errors.New("token is not exists")
+		}
+		return nil
+	}
+	testHandler := NewHandler(&conf, db, NewShortToken(conf.TokenLength))
+	go func() {
+		require.Equal(t, http.ErrServerClosed, testHandler.start())
+	}()
+	defer testHandler.stop()
+	require.Eventually(t, checkStart("http://localhost:8080/"), time.Second, 10*time.Millisecond)
+
+	// lifecycle webhooks are set at runtime
+	handler := testHandler.(*serviceHandler)
+	config := *handler.conf()
+	require.NoError(t, config.LifecycleWebhooks.UnmarshalText([]byte(srv.URL+"/all,deleted+expired="+srv.URL+"/deleted")))
+	handler.config.Store(&config)
+	// health check tokens are not reported
+	require.NoError(t, handler.healthCheck())
+
+	post := func(path, body string) int {
+		status, _ := postJSON(t, "http://localhost:8080/api/v1/"+path, body)
+		return status
+	}
+	status, sToken := newToken(t, "localhost:8080", `{"url":"http://some.url"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusOK, post("update", `{"token":"AAAAAA","url":"other.url"}`))
+	require.Equal(t, http.StatusNotModified, post("update", `{"token":"BBBBBB","url":"other.url"}`))
+	require.Equal(t, http.StatusBadRequest, post("update", `{"token":"AAAAAA"}`))
+	require.Equal(t, http.StatusOK, post("expire", `{"token":"AAAAAA","exp":2}`))
+	require.Equal(t, http.StatusOK, post("expire", `{"token":"AAAAAA"}`))
+	require.Equal(t, http.StatusOK, post("delete", `{"token":"AAAAAA"}`))
+	require.Equal(t, http.StatusBadRequest, post("delete", `{}`))
+	// token expired by TTL is reported once (the other service instance gets the same notification)
+	expired := <-watched
+	expired("CCCCCC")
+	expired("CCCCCC")
+	// token expired by TTL is found by sweeping
+	go handler.sweepExpired(10 * time.Millisecond)
+
+	require.Eventually(t, func() bool { return len(events()["/all"]) == 7 }, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{
+		"created " + sToken + " http://some.url",
+		"updated AAAAAA http://other.url",
+		"updated AAAAAA ",
+		"expired AAAAAA ",
+		"deleted AAAAAA ",
+		"expired CCCCCC ",
+		"expired DDDDDD ",
+	}, events()["/all"])
+	require.Equal(t, []string{"expired AAAAAA ", "deleted AAAAAA ", "expired CCCCCC ", "expired DDDDDD "}, events()["/deleted"])
+}
+
+func Test10Service09Events(t *testing.T) {
+	conf := Config{
+		ListenHostPort: "localhost:8080",
+		ShortDomain:    "localhost:8080",
+		Timeout:        500,
+		RedirectCode:   http.StatusFound,
+		URLSchemes:     []string{"http", "https"},
+		TokenLength:    6,
+		DefaultExp:     1,
+		AdminKey:       "secret",
+		BotPatterns:    []string{"go-http-client"},
+	}
+	db := newMockDB()
+	db.getFunc = func(sToken string) (string, error) {
+		if sToken == "BBBBBB" {
+			return `{"url":"http://localhost:8080/favicon.ico","owner":"someone"}`, nil
+		}
+		return "http://localhost:8080/favicon.ico", nil
+	}
+	testHandler := NewHandler(&conf, db, NewShortToken(conf.TokenLength))
+	go func() {
+		require.Equal(t, http.ErrServerClosed, testHandler.start())
+	}()
+	require.Eventually(t, checkStart("http://localhost:8080/"), time.Second, 10*time.Millisecond)
+
+	feed := func(key, query string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/events"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	resp := feed("wrong", "")
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	all := feed("secret", "")
+	defer all.Body.Close()
+	require.Equal(t, http.StatusOK, all.StatusCode)
+	require.Equal(t, "text/event-stream", all.Header.Get("Content-Type"))
+	one := feed("secret", "?token=BBBBBB")
+	defer one.Body.Close()
+	owned := feed("secret", "?owner=someone")
+	defer owned.Body.Close()
+	require.Equal(t, http.StatusOK, owned.StatusCode)
+
+	resp, err := noRedirectClient.Get("http://localhost:8080/AAAAAA")
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = browserGet("http://localhost:8080/BBBBBB")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	readEvent := func(r *bufio.Reader) string {
+		lines := []string{}
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	allEvents, oneEvents := bufio.NewReader(all.Body), bufio.NewReader(one.Body)
+	event := readEvent(allEvents)
+	require.Contains(t, event, "event: redirect\ndata: {\"token\":\"AAAAAA\",")
+	require.Contains(t, event, `"bot":true}`)
+	event = readEvent(allEvents)
+	require.Contains(t, event, "event: redirect\ndata: {\"token\":\"BBBBBB\",")
+	require.NotContains(t, event, `"bot"`)
+	require.Contains(t, readEvent(oneEvents), `"token":"BBBBBB"`)
+	event = readEvent(bufio.NewReader(owned.Body))
+	require.Contains(t, event, `"token":"BBBBBB"`)
+	require.Contains(t, event, `"owner":"someone"`)
+
+	// streams are finished on stop
+	testHandler.stop()
+	_, err = io.ReadAll(all.Body)
+	require.NoError(t, err)
+}
+
 // try to start service
 func Test10Service05All(t *testing.T) {
 	envSet(t)
@@ -147,6 +606,7 @@ func Test10Service05All(t *testing.T) {
 
 	require.Eventually(t, checkStart("http://"+testConfig.ListenHostPort), time.Second, 100*time.Millisecond)
 	require.Contains(t, out, "starting server at")
+	apiURL := "http://" + testConfig.ListenHostPort + "/api/v1/"
 
 	t.Run("do health check", func(t *testing.T) {
 		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/healthcheck")
@@ -157,10 +617,14 @@ func Test10Service05All(t *testing.T) {
 		buf, err := io.ReadAll(resp.Body)
 		require.NoError(t, err)
 		require.Contains(t, string(buf), "Health check page")
+		require.Contains(t, string(buf), "Service mode: "+testConfig.Mode.String())
+		require.Contains(t, string(buf), "Dropped click events: 0")
 	})
 
 	t.Run("bad method", func(t *testing.T) {
-		resp, err := http.Head("http://" + testConfig.ListenHostPort)
+		req, err := http.NewRequest(http.MethodPut, "http://"+testConfig.ListenHostPort, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
 		require.NoError(t, err)
 		defer resp.Body.Close()
 		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
@@ -192,6 +656,605 @@ func Test10Service05All(t *testing.T) {
 		require.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 
+	t.Run("token info with clicks", func(t *testing.T) {
+		status, sToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://`+testConfig.ShortDomain+`/favicon.ico"}`)
+		require.Equal(t, http.StatusOK, status)
+
+		info := func() (int, string) {
+			resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + sToken)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			buf, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp.StatusCode, string(buf)
+		}
+		status, body := info()
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, `"long_url":"http://`+testConfig.ShortDomain+`/favicon.ico"`)
+		require.Contains(t, body, `"clicks":{"count":0,"bots":0}`)
+
+		resp2, err := browserGet("http://" + testConfig.ShortDomain + "/" + sToken)
+		require.NoError(t, err)
+		resp2.Body.Close()
+		// HEAD request is counted as bot hit but it is redirected too
+		resp2, err = noRedirectClient.Head("http://" + testConfig.ShortDomain + "/" + sToken)
+		require.NoError(t, err)
+		resp2.Body.Close()
+		require.Equal(t, http.StatusFound, resp2.StatusCode)
+		require.Eventually(t, func() bool {
+			_, body := info()
+			return strings.Contains(body, `"clicks":{"count":1,"bots":1,"first_seen":`)
+		}, 3*time.Second, 100*time.Millisecond)
+
+		resp3, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + strings.Repeat("A", testConfig.TokenLength))
+		require.NoError(t, err)
+		resp3.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp3.StatusCode)
+	})
+
+	t.Run("redirect status code", func(t *testing.T) {
+		redirect := func(sToken string) int {
+			status, _, _ := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+sToken, "")
+			return status
+		}
+
+		status, _ := newToken(t, testConfig.ListenHostPort, `{"url": "http://`+testConfig.ShortDomain+`/favicon.ico", "redirect": 200}`)
+		require.Equal(t, http.StatusBadRequest, status)
+
+		status, linkToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://`+testConfig.ShortDomain+`/favicon.ico", "redirect": 308}`)
+		require.Equal(t, http.StatusOK, status)
+		_, defaultToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://`+testConfig.ShortDomain+`/favicon.ico"}`)
+		require.Equal(t, http.StatusPermanentRedirect, redirect(linkToken))
+		require.Equal(t, http.StatusFound, redirect(defaultToken))
+
+		// the default redirect status code is taken from the current configuration
+		handler := serviceTestHandler.(*serviceHandler)
+		current := handler.conf()
+		config := *current
+		config.RedirectCode = http.StatusMovedPermanently
+		handler.config.Store(&config)
+		defer handler.config.Store(current)
+		require.Equal(t, http.StatusPermanentRedirect, redirect(linkToken))
+		require.Equal(t, http.StatusMovedPermanently, redirect(defaultToken))
+
+		// 307 and 308 redirects preserve the request method, the other links don't accept it
+		status, tempToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://`+testConfig.ShortDomain+`/favicon.ico", "redirect": 307}`)
+		require.Equal(t, http.StatusOK, status)
+		post := func(sToken string) (int, string) {
+			resp, err := noRedirectClient.Post("http://"+testConfig.ShortDomain+"/"+sToken, "application/json", strings.NewReader(`{}`))
+			require.NoError(t, err)
+			resp.Body.Close()
+			return resp.StatusCode, resp.Header.Get("Location")
+		}
+		for sToken, code := range map[string]int{tempToken: http.StatusTemporaryRedirect, linkToken: http.StatusPermanentRedirect} {
+			status, location := post(sToken)
+			require.Equal(t, code, status)
+			require.Equal(t, "http://"+testConfig.ShortDomain+"/favicon.ico", location)
+		}
+		status, _ = post(defaultToken)
+		require.Equal(t, http.StatusBadRequest, status)
+
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + linkToken)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buf), `"long_url":"http://`+testConfig.ShortDomain+`/favicon.ico","redirect":308`)
+	})
+
+	t.Run("query and path passthrough", func(t *testing.T) {
+		passToken, err := serviceTestHandler.(*serviceHandler).generateToken(Link{URL: "http://example.com/base?a=1",
+			LinkOptions: LinkOptions{PassQuery: true, PassPath: true}}, 1)
+		require.NoError(t, err)
+		plainToken, err := serviceTestHandler.(*serviceHandler).generateToken(Link{URL: "http://example.com/base?a=1"}, 1)
+		require.NoError(t, err)
+		redirect := func(path string) (int, string) {
+			status, location, _ := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+path, "")
+			return status, location
+		}
+
+		status, location := redirect(passToken + "/docs/page?a=2&b=3")
+		require.Equal(t, http.StatusFound, status)
+		require.Equal(t, "http://example.com/base/docs/page?a=1&b=3", location)
+		status, location = redirect(plainToken + "?b=3")
+		require.Equal(t, http.StatusFound, status)
+		require.Equal(t, "http://example.com/base?a=1", location)
+		status, _ = redirect(plainToken + "/docs/page")
+		require.Equal(t, http.StatusNotFound, status)
+		// the suffix can't lead out of the long URL path
+		status, _ = redirect(passToken + "/../../other")
+		require.Equal(t, http.StatusNotFound, status)
+		status, _ = redirect(passToken + "/docs/%2E%2E/%2e%2e/other")
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("UTM parameters", func(t *testing.T) {
+		status, sToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://example.com/?utm_source=own", "utm": {"source": "news", "medium": "email", "campaign": "spring"}}`)
+		require.Equal(t, http.StatusOK, status)
+
+		_, location, _ := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+sToken, "")
+		require.Equal(t, "http://example.com/?utm_source=own&utm_medium=email&utm_campaign=spring", location)
+
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + sToken)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buf), `"utm":{"source":"news","medium":"email","campaign":"spring"}`)
+	})
+
+	t.Run("click limited link", func(t *testing.T) {
+		redirect := func(sToken, userAgent string) (int, string) {
+			status, _, body := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+sToken, userAgent)
+			return status, body
+		}
+		browser := "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+
+		status, _ := newToken(t, testConfig.ListenHostPort, `{"url": "http://example.com/", "max_clicks": -1}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		status, sToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://example.com/", "max_clicks": 1}`)
+		require.Equal(t, http.StatusOK, status)
+
+		// bots are redirected but they don't use up the link
+		for _, bot := range []string{"Slackbot-LinkExpanding 1.0", "curl/8.0", ""} {
+			status, _ = redirect(sToken, bot)
+			require.Equal(t, http.StatusFound, status, bot)
+		}
+		status, _ = redirect(sToken, browser)
+		require.Equal(t, http.StatusFound, status)
+		status, body := redirect(sToken, browser)
+		require.Equal(t, http.StatusGone, status)
+		require.Contains(t, body, "Link already used")
+		status, _ = redirect(sToken, "curl/8.0")
+		require.Equal(t, http.StatusGone, status)
+
+		// custom page
+		page := filepath.Join(t.TempDir(), "used.html")
+		require.NoError(t, os.WriteFile(page, []byte("<html>used</html>"), 0600))
+		handler := serviceTestHandler.(*serviceHandler)
+		current := handler.conf()
+		config := *current
+		require.NoError(t, config.UsedLinkPage.UnmarshalText([]byte(page)))
+		require.Error(t, (&pageFile{}).UnmarshalText([]byte(page+".missing")))
+		handler.config.Store(&config)
+		defer handler.config.Store(current)
+		// the page is read with the configuration
+		require.NoError(t, os.Remove(page))
+		status, body = redirect(sToken, browser)
+		require.Equal(t, http.StatusGone, status)
+		require.Equal(t, "<html>used</html>", body)
+	})
+
+	t.Run("scheduled activation", func(t *testing.T) {
+		launch := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		status, pToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://example.com/", "not_before": "`+launch+`"}`)
+		require.Equal(t, http.StatusOK, status)
+		redirect := func() (int, string) {
+			status, _, body := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+pToken, "")
+			return status, body
+		}
+
+		status, _ = redirect()
+		require.Equal(t, http.StatusNotFound, status)
+
+		resp2, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + pToken)
+		require.NoError(t, err)
+		defer resp2.Body.Close()
+		buf, err := io.ReadAll(resp2.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buf), `"not_before":"`+launch+`","pending":true`)
+
+		// teaser page
+		page := filepath.Join(t.TempDir(), "teaser.html")
+		require.NoError(t, os.WriteFile(page, []byte("<html>coming soon</html>"), 0600))
+		handler := serviceTestHandler.(*serviceHandler)
+		current := handler.conf()
+		config := *current
+		require.NoError(t, config.PendingLinkPage.UnmarshalText([]byte(page)))
+		handler.config.Store(&config)
+		defer handler.config.Store(current)
+		status, body := redirect()
+		require.Equal(t, http.StatusNotFound, status)
+		require.Equal(t, "<html>coming soon</html>", body)
+
+		// the link is active after activation time
+		sToken, err := handler.generateToken(Link{URL: "http://example.com/", LinkOptions: LinkOptions{NotBefore: time.Now().Add(-time.Minute)}}, 1)
+		require.NoError(t, err)
+		resp3, err := noRedirectClient.Get("http://" + testConfig.ShortDomain + "/" + sToken)
+		require.NoError(t, err)
+		resp3.Body.Close()
+		require.Equal(t, http.StatusFound, resp3.StatusCode)
+
+		status, _ = newToken(t, testConfig.ListenHostPort, `{"url": "http://example.com/", "not_before": "tomorrow"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("fallback URL after expiration", func(t *testing.T) {
+		handler := serviceTestHandler.(*serviceHandler)
+		linkToken, err := handler.generateToken(Link{URL: "http://example.com/", LinkOptions: LinkOptions{FallbackURL: "http://example.com/expired"}}, 1)
+		require.NoError(t, err)
+		plainToken, err := handler.generateToken(Link{URL: "http://example.com/"}, 1)
+		require.NoError(t, err)
+		expire := func(sToken string) {
+			status, _ := postJSON(t, "http://"+testConfig.ListenHostPort+"/api/v1/expire", `{"token": "`+sToken+`", "exp": -1}`)
+			require.Equal(t, http.StatusOK, status)
+		}
+		redirect := func(sToken string) (int, string) {
+			status, location, _ := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+sToken, "")
+			return status, location
+		}
+		// the tombstone is not stored when there is no fallback URL
+		expire(plainToken)
+		_, err = serviceTestDB.GetFallback(plainToken)
+		require.Error(t, err)
+
+		current := handler.conf()
+		config := *current
+		config.FallbackURL = "http://example.com/default"
+		handler.config.Store(&config)
+		defer handler.config.Store(current)
+		defaultToken, err := handler.generateToken(Link{URL: "http://example.com/"}, 1)
+		require.NoError(t, err)
+		// the tombstone is never stored for health check token
+		checkToken, err := handler.generateToken(Link{URL: handler.healthCheckURL()}, 1)
+		require.NoError(t, err)
+		expire(linkToken)
+		expire(defaultToken)
+		expire(checkToken)
+		_, err = serviceTestDB.GetFallback(checkToken)
+		require.Error(t, err)
+
+		status, location := redirect(linkToken)
+		require.Equal(t, http.StatusFound, status)
+		require.Equal(t, "http://example.com/expired", location)
+		// the default fallback URL is used for expired tokens without their own fallback URL
+		status, location = redirect(defaultToken)
+		require.Equal(t, http.StatusFound, status)
+		require.Equal(t, "http://example.com/default", location)
+		// but not for tokens that had no fallback URL when the tombstone was stored or that never existed
+		status, _ = redirect(plainToken)
+		require.Equal(t, http.StatusNotFound, status)
+		status, _ = redirect(strings.Repeat("A", testConfig.TokenLength))
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("password protected link", func(t *testing.T) {
+		status, pToken := newToken(t, testConfig.ListenHostPort, `{"url": "http://example.com/", "password": "secret"}`)
+		require.Equal(t, http.StatusOK, status)
+		shortURL := "http://" + testConfig.ShortDomain + "/" + pToken
+		submit := func(password string) (int, string, string) {
+			resp, err := noRedirectClient.PostForm(shortURL, url.Values{"password": {password}})
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			buf, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp.StatusCode, resp.Header.Get("Location"), string(buf)
+		}
+
+		status, _, body := redirectGet(t, shortURL, "")
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, `<input type=password name=password`)
+
+		// right attempts are not limited
+		for range testConfig.PasswordAttempts + 1 {
+			status, location, _ := submit("secret")
+			require.Equal(t, http.StatusFound, status)
+			require.Equal(t, "http://example.com/", location)
+		}
+
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + pToken)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buf), `"protected":true`)
+		require.NotContains(t, string(buf), "password")
+		require.NotContains(t, string(buf), "example.com")
+
+		// wrong attempts are limited
+		for range testConfig.PasswordAttempts {
+			status, _, body := submit("wrong")
+			require.Equal(t, http.StatusForbidden, status)
+			require.Contains(t, body, "Wrong password")
+		}
+		status, _, body = submit("secret")
+		require.Equal(t, http.StatusTooManyRequests, status)
+		require.Contains(t, body, "Too many wrong attempts")
+
+		// parallel wrong attempts can't exceed the limit
+		status, pToken = newToken(t, testConfig.ListenHostPort, `{"url": "http://example.com/", "password": "secret"}`)
+		require.Equal(t, http.StatusOK, status)
+		shortURL = "http://" + testConfig.ShortDomain + "/" + pToken
+		statuses := make(chan int, 4*testConfig.PasswordAttempts)
+		wg := sync.WaitGroup{}
+		for range cap(statuses) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := noRedirectClient.PostForm(shortURL, url.Values{"password": {"wrong"}})
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		checked := 0
+		for status := range statuses {
+			require.Contains(t, []int{http.StatusForbidden, http.StatusTooManyRequests}, status)
+			if status == http.StatusForbidden {
+				checked++
+			}
+		}
+		require.Equal(t, testConfig.PasswordAttempts, checked)
+
+		// not protected link doesn't accept POST requests
+		sToken, err := serviceTestHandler.(*serviceHandler).generateToken(Link{URL: "http://example.com/"}, 1)
+		require.NoError(t, err)
+		resp4, err := noRedirectClient.PostForm("http://"+testConfig.ShortDomain+"/"+sToken, url.Values{"password": {"secret"}})
+		require.NoError(t, err)
+		resp4.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp4.StatusCode)
+	})
+
+	t.Run("preview page", func(t *testing.T) {
+		handler := serviceTestHandler.(*serviceHandler)
+		sToken, err := handler.generateToken(Link{URL: "http://example.com/base", LinkOptions: LinkOptions{Title: "<Launch>", PassPath: true}}, 1)
+		require.NoError(t, err)
+		alwaysToken, err := handler.generateToken(Link{URL: "http://example.com/", LinkOptions: LinkOptions{Preview: true}}, 1)
+		require.NoError(t, err)
+		plainToken, err := handler.generateToken(Link{URL: "http://example.com/plain"}, 1)
+		require.NoError(t, err)
+		// the creation time is stored separately, the plain link is stored as long URL
+		value, err := serviceTestDB.Get(sToken)
+		require.NoError(t, err)
+		require.NotContains(t, value, `"created":"`)
+		value, err = serviceTestDB.Get(plainToken)
+		require.NoError(t, err)
+		require.Equal(t, "http://example.com/plain", value)
+		// the link record of previous version has the creation time
+		oldToken, err := handler.generateToken(Link{URL: "http://example.com/old"}, 1)
+		require.NoError(t, err)
+		require.NoError(t, serviceTestDB.Update(oldToken, `{"url":"http://example.com/old","created":"2020-01-02T00:00:00Z"}`))
+		get := func(path string) (int, string) {
+			status, _, body := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+path, "")
+			return status, body
+		}
+		clicks := func(sToken string) int64 {
+			clicks, err := serviceTestDB.GetClicks(sToken)
+			require.NoError(t, err)
+			return clicks.Count + clicks.Bots
+		}
+
+		// requested preview is not counted and it continues to the short URL
+		status, body := get(sToken + "+/docs?a=1")
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, "<h1>&lt;Launch&gt;</h1>")
+		require.Contains(t, body, "<b>http://example.com/base/docs</b>")
+		require.Contains(t, body, "Created: "+time.Now().UTC().Format(time.DateOnly))
+		require.Contains(t, body, `<a href="/`+sToken+`/docs?a=1">Continue</a>`)
+		status, _ = get(sToken)
+		require.Equal(t, http.StatusFound, status)
+		status, body = get(plainToken + "+")
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, "<b>http://example.com/plain</b>")
+		require.Contains(t, body, "Created: "+time.Now().UTC().Format(time.DateOnly))
+		status, body = get(oldToken + "+")
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, "Created: 2020-01-02")
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + plainToken)
+		require.NoError(t, err)
+		info, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Contains(t, string(info), `"created":"`+time.Now().UTC().Format(time.DateOnly))
+
+		// always previewed link is counted and it continues to the long URL
+		status, body = get(alwaysToken)
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, `<a href="http://example.com/">Continue</a>`)
+		require.Eventually(t, func() bool { return clicks(sToken) == 1 && clicks(alwaysToken) == 1 }, 3*time.Second, 100*time.Millisecond)
+
+		// preview of not existing token
+		status, _ = get(strings.Repeat("A", testConfig.TokenLength) + "+")
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("device routing", func(t *testing.T) {
+		status, _ := newToken(t, testConfig.ListenHostPort, `{"url": "https://example.com/", "routes": [{"os": "symbian", "url": "https://example.com/s"}]}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		status, sToken := newToken(t, testConfig.ListenHostPort, `{"url": "https://example.com/", "routes": [{"os": "ios", "url": "https://apps.apple.com/app/id1"},
+			{"os": "android", "url": "https://play.google.com/store/apps/details?id=app"}]}`)
+		require.Equal(t, http.StatusOK, status)
+
+		redirect := func(ua string) string {
+			status, location, _ := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+sToken, ua)
+			require.Equal(t, http.StatusFound, status)
+			return location
+		}
+		require.Equal(t, "https://apps.apple.com/app/id1", redirect("Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148"))
+		require.Equal(t, "https://play.google.com/store/apps/details?id=app", redirect("Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36"))
+		require.Equal(t, "https://example.com/", redirect("Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"))
+	})
+
+	t.Run("A/B variants", func(t *testing.T) {
+		status, vToken := newToken(t, testConfig.ListenHostPort, `{"url": "https://example.com/", "sticky": true, "variants": [{"name": "a", "url": "https://example.com/a", "weight": 1},
+			{"name": "b", "url": "https://example.com/b", "weight": 1}]}`)
+		require.Equal(t, http.StatusOK, status)
+		redirect := func(cookie *http.Cookie) (string, *http.Cookie) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+testConfig.ShortDomain+"/"+vToken, nil)
+			require.NoError(t, err)
+			req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0")
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			resp, err := noRedirectClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusFound, resp.StatusCode)
+			cookies := resp.Cookies()
+			require.Len(t, cookies, 1)
+			return resp.Header.Get("Location"), cookies[0]
+		}
+
+		location, cookie := redirect(nil)
+		require.Equal(t, "https://example.com/"+cookie.Value, location)
+		require.Equal(t, "/"+vToken, cookie.Path)
+		for range 5 {
+			next, _ := redirect(cookie)
+			require.Equal(t, location, next)
+		}
+
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + vToken + "/stats")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var report StatsReport
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+			return slices.Equal(report.Variants, []StatsItem{{cookie.Value, 6}})
+		}, 3*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("long URL validation", func(t *testing.T) {
+		status, body := postJSON(t, apiURL+"token", `{"url": "javascript:alert(1)"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.JSONEq(t, `{"error": "scheme_not_allowed", "message": "scheme 'javascript' is not allowed"}`, body)
+		status, body = postJSON(t, apiURL+"token", `{"url": "http://exa_mple.com/"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"invalid_host"`)
+		status, body = postJSON(t, apiURL+"token", `{"url": "httpfoo"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"invalid_host"`)
+
+		status, body = postJSON(t, apiURL+"token", `{"url": "HTTPS://Bücher.Example:443/Path"}`)
+		require.Equal(t, http.StatusOK, status)
+		var repl struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &repl))
+		link, err := serviceTestHandler.(*serviceHandler).getLink(repl.Token)
+		require.NoError(t, err)
+		require.Equal(t, "https://xn--bcher-kva.example/Path", link.URL)
+
+		status, body = postJSON(t, apiURL+"update", `{"token": "`+repl.Token+`", "url": "http://user@example.com/"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"userinfo_not_allowed"`)
+		status, _ = postJSON(t, apiURL+"update", `{"token": "`+repl.Token+`", "url": "Example.com:80/new"}`)
+		require.Equal(t, http.StatusOK, status)
+		link, err = serviceTestHandler.(*serviceHandler).getLink(repl.Token)
+		require.NoError(t, err)
+		require.Equal(t, "http://example.com/new", link.URL)
+
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/ui/generate?s=" + url.QueryEscape("data:text/html,x"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("destination domains", func(t *testing.T) {
+		handler := serviceTestHandler.(*serviceHandler)
+		oldToken, err := handler.generateToken(Link{URL: "http://phish.example.org/login"}, 1)
+		require.NoError(t, err)
+
+		current := handler.conf()
+		config := *current
+		config.AllowListFile = writeDomainList(t, ".example.com\n.example.org\n")
+		config.BlockListFile = writeDomainList(t, "phish.example.org\n")
+		handler.config.Store(&config)
+		defer handler.config.Store(current)
+
+		status, body := postJSON(t, apiURL+"token", `{"url": "https://phish.example.org/login"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"domain_blocked"`)
+		status, body = postJSON(t, apiURL+"token", `{"url": "https://example.net/"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"domain_not_allowed"`)
+		status, body = postJSON(t, apiURL+"token", `{"url": "https://www.example.com/", "variants": [{"name": "a", "url": "https://example.net/", "weight": 1}]}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"domain_not_allowed"`)
+		// the fallback, route and variant URLs are normalized before the check
+		status, body = postJSON(t, apiURL+"token", `{"url": "https://www.example.com/", "fallback_url": "https://PHISH.Example.org./"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"domain_blocked"`)
+		status, body = postJSON(t, apiURL+"token", `{"url": "https://www.example.com/", "routes": [{"os": "ios", "url": "https://www.example.com@phish.example.org/"}]}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"userinfo_not_allowed"`)
+		status, body = postJSON(t, apiURL+"token", `{"url": "https://www.example.com/"}`)
+		require.Equal(t, http.StatusOK, status)
+		var repl struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &repl))
+		status, body = postJSON(t, apiURL+"update", `{"token": "`+repl.Token+`", "url": "https://phish.example.org/"}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		require.Contains(t, body, `"error":"domain_blocked"`)
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/ui/generate?s=" + url.QueryEscape("https://example.net/"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		// the short domain is always allowed (the health check shortens the service URL)
+		resp, err = http.Get("http://" + testConfig.ListenHostPort + "/api/v1/healthcheck")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// the links created before the rules are rechecked on redirect only when it is enabled
+		redirect := func(sToken string) int {
+			status, _, _ := redirectGet(t, "http://"+testConfig.ShortDomain+"/"+sToken, "")
+			return status
+		}
+		require.Equal(t, http.StatusFound, redirect(oldToken))
+		recheck := config
+		recheck.RecheckDomains = true
+		handler.config.Store(&recheck)
+		require.Equal(t, http.StatusForbidden, redirect(oldToken))
+		require.Equal(t, http.StatusFound, redirect(repl.Token))
+	})
+
+	t.Run("token stats", func(t *testing.T) {
+		sToken, err := serviceTestHandler.(*serviceHandler).generateToken(Link{URL: "http://" + testConfig.ShortDomain + "/favicon.ico"}, 1)
+		require.NoError(t, err)
+
+		stats := func(query string) (int, string) {
+			resp, err := http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + sToken + "/stats" + query)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			buf, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp.StatusCode, string(buf)
+		}
+
+		resp, err := browserGet("http://" + testConfig.ShortDomain + "/" + sToken)
+		require.NoError(t, err)
+		resp.Body.Close()
+		// Go HTTP client is a bot
+		resp, err = http.Get("http://" + testConfig.ShortDomain + "/" + sToken)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Eventually(t, func() bool {
+			_, body := stats("")
+			return strings.Contains(body, `"total":1,"bots":1,`)
+		}, 3*time.Second, 100*time.Millisecond)
+
+		status, body := stats("?granularity=hour&from=" + time.Now().UTC().Add(-2*time.Hour).Format(time.RFC3339))
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, `"granularity":"hour","total":1,`)
+		require.Contains(t, body, `"referrers":[{"name":"direct","count":1}]`)
+		require.Contains(t, body, `"user_agents":[{"name":"bot","count":1},{"name":"browser","count":1}]`)
+		require.Contains(t, body, `"countries":[{"name":"unknown","count":1}]`)
+
+		status, _ = stats("?granularity=week")
+		require.Equal(t, http.StatusBadRequest, status)
+
+		resp, err = http.Get("http://" + testConfig.ListenHostPort + "/api/v1/token/" + strings.Repeat("A", testConfig.TokenLength) + "/stats")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
 	t.Run("expire request without parameters", func(t *testing.T) {
 		resp, err := http.Post("http://"+testConfig.ListenHostPort+"/api/v1/expire", "application/json",
 			strings.NewReader(``))
@@ -322,7 +1385,7 @@ func Test10Service05All(t *testing.T) {
 	})
 
 	t.Run("generate UI interface with QR", func(t *testing.T) {
-		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/ui/generate?s=http:/some.url")
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/ui/generate?s=http://some.url")
 		require.NoError(t, err)
 		defer resp.Body.Close()
 
@@ -335,7 +1398,7 @@ func Test10Service05All(t *testing.T) {
 
 	t.Run("generate UI interface disabled", func(t *testing.T) {
 		testConfig.Mode = disableUI
-		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/ui/generate?s=http:/some.url")
+		resp, err := http.Get("http://" + testConfig.ListenHostPort + "/ui/generate?s=http://some.url")
 		require.NoError(t, err)
 		defer resp.Body.Close()
 
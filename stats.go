@@ -0,0 +1,241 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains clicks analytics tools
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClickStats is the time bucketed clicks statistics of token: counters by statistics fields.
+// Field names are:
+//   - "h:<hour>" - number of clicks during the hour (hours since unix epoch)
+//   - "d:<day>" - number of clicks during the day (days since unix epoch)
+//   - "r:<day>:<referrer host>" - number of clicks from referrer during the day ("other" for hosts above the limit)
+//   - "n:<day>" - number of referrer hosts during the day
+//   - "u:<day>:<user agent class>" - number of clicks by user agent class during the day ("bot" for bot hits)
+//   - "c:<day>:<country ISO code>" - number of clicks from country during the day
+//   - "b:<day>" - number of bot hits during the day
+//   - "v:<day>:<variant>" - number of clicks redirected to variant during the day (for links with variants)
+//
+// All fields except "b:<day>" and "u:<day>:bot" count human clicks only. The hourly fields are kept for statsHourlyRetention, the
+// rest of fields live as long as the token.
+type ClickStats map[string]int64
+
+const (
+	// user agent classes
+	uaBrowser = "browser"
+	uaMobile  = "mobile"
+	uaBot     = "bot"
+	uaOther   = "other"
+
+	// statistics granularity
+	granularityHour = "hour"
+	granularityDay  = "day"
+
+	// unknownValue is used for unknown referrer and country
+	unknownValue = "unknown"
+
+	statsTopReferrers    = 10   // maximum number of referrers in statistics report
+	statsMaxBuckets      = 1000 // maximum number of time buckets in statistics report
+	statsDefaultPeriod   = 7 * 24 * time.Hour
+	statsHourlyRetention = 30 * 24 * time.Hour // retention period of hourly statistics
+	statsMaxReferrers    = 100                 // maximum number of referrer hosts per day, the rest are counted as "other"
+)
+
+// substrings of lower case user agent that identify the mobile user agent
+var uaMobileMarks = []string{"mobile", "android", "iphone", "ipad", "ipod", "windows phone"}
+
+// uaClass returns coarse class of the (human) user agent: mobile, browser or other
+func uaClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case containsAny(ua, uaMobileMarks):
+		return uaMobile
+	case strings.HasPrefix(ua, "mozilla/") || strings.HasPrefix(ua, "opera/"):
+		return uaBrowser
+	}
+	return uaOther
+}
+
+// containsAny returns true when s contains any of substrings
+func containsAny(s string, substrings []string) bool {
+	return slices.ContainsFunc(substrings, func(sub string) bool { return strings.Contains(s, sub) })
+}
+
+// referrerHost returns the host of referrer URL, "direct" for empty referrer or "unknown" for unparsable one
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return "direct"
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Hostname() == "" {
+		return unknownValue
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// add adds the click to the statistics
+func (s ClickStats) add(t time.Time, referrer, agentClass, country, variant string) {
+	hour, day := t.Unix()/3600, t.Unix()/86400
+	s["h:"+strconv.FormatInt(hour, 10)]++
+	s["d:"+strconv.FormatInt(day, 10)]++
+	s[fmt.Sprintf("r:%d:%s", day, referrer)]++
+	s[fmt.Sprintf("u:%d:%s", day, agentClass)]++
+	s[fmt.Sprintf("c:%d:%s", day, cmp.Or(country, unknownValue))]++
+	if variant != "" {
+		s[fmt.Sprintf("v:%d:%s", day, variant)]++
+	}
+}
+
+// addBot adds the bot hit to the statistics
+func (s ClickStats) addBot(t time.Time) {
+	day := t.Unix() / 86400
+	s["b:"+strconv.FormatInt(day, 10)]++
+	s[fmt.Sprintf("u:%d:%s", day, uaBot)]++
+}
+
+// StatsBucket is the number of clicks during the time bucket
+type StatsBucket struct {
+	Time  time.Time `json:"time"`  // bucket start time
+	Count int64     `json:"count"` // number of clicks
+}
+
+// StatsItem is the number of clicks by some value (referrer, user agent class, country or variant)
+type StatsItem struct {
+	Name  string `json:"name"`  // value
+	Count int64  `json:"count"` // number of clicks
+}
+
+// StatsReport is the clicks statistics of token for the time period
+type StatsReport struct {
+	Token       string        `json:"token"`              // token
+	From        time.Time     `json:"from"`               // period start
+	To          time.Time     `json:"to"`                 // period end
+	Granularity string        `json:"granularity"`        // clicks histogram granularity: hour or day
+	Total       int64         `json:"total"`              // total number of clicks during the period
+	Bots        int64         `json:"bots"`               // number of bot hits during the whole days of the period
+	Clicks      []StatsBucket `json:"clicks"`             // clicks histogram
+	Referrers   []StatsItem   `json:"referrers"`          // top referrers (breakdowns are made by whole days of the period)
+	UserAgents  []StatsItem   `json:"user_agents"`        // user agent classes
+	Countries   []StatsItem   `json:"countries"`          // countries
+	Variants    []StatsItem   `json:"variants,omitempty"` // variants (for links with variants)
+}
+
+// parseStatsPeriod parses statistics request parameters: from and to are RFC3339 time or date (YYYY-MM-DD),
+// granularity is hour or day. The defaults are: last 7 days by days.
+func parseStatsPeriod(from, to, granularity string, now time.Time) (time.Time, time.Time, string, error) {
+	var err error
+	end := now.UTC()
+	if to != "" {
+		if end, err = parseStatsTime(to); err != nil {
+			return time.Time{}, time.Time{}, "", fmt.Errorf("wrong 'to' parameter: %w", err)
+		}
+	}
+	start := end.Add(-statsDefaultPeriod)
+	if from != "" {
+		if start, err = parseStatsTime(from); err != nil {
+			return time.Time{}, time.Time{}, "", fmt.Errorf("wrong 'from' parameter: %w", err)
+		}
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, "", errors.New("'from' must be before 'to'")
+	}
+	granularity = cmp.Or(granularity, granularityDay)
+	bucket := bucketSize(granularity)
+	if bucket == 0 {
+		return time.Time{}, time.Time{}, "", fmt.Errorf("unsupported granularity '%s'", granularity)
+	}
+	if end.Sub(start)/bucket > statsMaxBuckets {
+		return time.Time{}, time.Time{}, "", fmt.Errorf("too long period for %s granularity", granularity)
+	}
+	return start, end, granularity, nil
+}
+
+// parseStatsTime parses RFC3339 time or date
+func parseStatsTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t.UTC(), err
+}
+
+// bucketSize returns the duration of time bucket for granularity or 0 for unsupported granularity
+func bucketSize(granularity string) time.Duration {
+	switch granularity {
+	case granularityHour:
+		return time.Hour
+	case granularityDay:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// report makes the statistics report for the period [from, to) with given granularity
+func (s ClickStats) report(sToken string, from, to time.Time, granularity string) StatsReport {
+	bucket := bucketSize(granularity)
+	prefix := granularity[:1] + ":"
+	rep := StatsReport{
+		Token:       sToken,
+		From:        from,
+		To:          to,
+		Granularity: granularity,
+		Clicks:      []StatsBucket{},
+	}
+	// histogram
+	for t := from.Truncate(bucket); t.Before(to); t = t.Add(bucket) {
+		count := s[prefix+strconv.FormatInt(t.Unix()/int64(bucket.Seconds()), 10)]
+		rep.Clicks = append(rep.Clicks, StatsBucket{t, count})
+		rep.Total += count
+	}
+	// breakdowns by days
+	firstDay, lastDay := from.Unix()/86400, (to.Unix()-1)/86400
+	breakdowns := map[string]map[string]int64{"r": {}, "u": {}, "c": {}, "v": {}}
+	for field, count := range s {
+		parts := strings.SplitN(field, ":", 3)
+		if len(parts) < 2 || (parts[0] != "b" && breakdowns[parts[0]] == nil) {
+			continue
+		}
+		day, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || day < firstDay || day > lastDay {
+			continue
+		}
+		if parts[0] == "b" {
+			rep.Bots += count
+		} else if len(parts) == 3 {
+			breakdowns[parts[0]][parts[2]] += count
+		}
+	}
+	rep.Referrers = statsItems(breakdowns["r"])
+	if len(rep.Referrers) > statsTopReferrers {
+		rep.Referrers = rep.Referrers[:statsTopReferrers]
+	}
+	rep.UserAgents = statsItems(breakdowns["u"])
+	rep.Countries = statsItems(breakdowns["c"])
+	rep.Variants = statsItems(breakdowns["v"])
+	return rep
+}
+
+// statsItems returns items sorted by count in descending order
+func statsItems(counts map[string]int64) []StatsItem {
+	items := make([]StatsItem, 0, len(counts))
+	for name, count := range counts {
+		items = append(items, StatsItem{name, count})
+	}
+	slices.SortFunc(items, func(a, b StatsItem) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Name, b.Name))
+	})
+	return items
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsUAClass(t *testing.T) {
+	for ua, class := range map[string]string{
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36":             uaBrowser,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148": uaMobile,
+		"SomeApp/1.0": uaOther,
+		"":            uaOther,
+	} {
+		require.Equal(t, class, uaClass(ua), ua)
+	}
+}
+
+func TestStatsReferrerHost(t *testing.T) {
+	require.Equal(t, "direct", referrerHost(""))
+	require.Equal(t, "example.com", referrerHost("https://Example.com:8080/page?q=1"))
+	require.Equal(t, unknownValue, referrerHost("::wrong"))
+	require.Equal(t, unknownValue, referrerHost("some text"))
+}
+
+func TestStatsPeriod(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+
+	from, to, granularity, err := parseStatsPeriod("", "", "", now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(-statsDefaultPeriod), from)
+	require.Equal(t, now, to)
+	require.Equal(t, granularityDay, granularity)
+
+	from, to, granularity, err = parseStatsPeriod("2024-05-01", "2024-05-02T10:00:00+02:00", "hour", now)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), from)
+	require.Equal(t, time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC), to)
+	require.Equal(t, granularityHour, granularity)
+
+	for _, params := range [][3]string{
+		{"wrong", "", ""},
+		{"", "wrong", ""},
+		{"2024-05-02", "2024-05-01", ""},
+		{"", "", "week"},
+		{"2020-01-01", "", "hour"},
+	} {
+		_, _, _, err := parseStatsPeriod(params[0], params[1], params[2], now)
+		require.Error(t, err, params)
+	}
+}
+
+func TestStatsReport(t *testing.T) {
+	stats := ClickStats{}
+	day1 := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	stats.add(day1, "direct", uaBrowser, "", "")
+	stats.add(day1.Add(time.Hour), "example.com", uaOther, "US", "b")
+	stats.addBot(day1)
+	stats.addBot(day2.Add(30 * 24 * time.Hour)) // out of period
+	stats.add(day2, "example.com", uaMobile, "US", "a")
+	stats.add(day2.Add(30*24*time.Hour), "other.com", uaMobile, "DE", "a") // out of period
+
+	rep := stats.report("AAAAAA", day1.Truncate(24*time.Hour), day2.Truncate(24*time.Hour).Add(24*time.Hour), granularityDay)
+	require.Equal(t, int64(3), rep.Total)
+	require.Equal(t, int64(1), rep.Bots)
+	require.Equal(t, []StatsBucket{
+		{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), 2},
+		{time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), 1},
+	}, rep.Clicks)
+	require.Equal(t, []StatsItem{{"example.com", 2}, {"direct", 1}}, rep.Referrers)
+	require.Equal(t, []StatsItem{{uaBot, 1}, {uaBrowser, 1}, {uaMobile, 1}, {uaOther, 1}}, rep.UserAgents)
+	require.Equal(t, []StatsItem{{"US", 2}, {unknownValue, 1}}, rep.Countries)
+	require.Equal(t, []StatsItem{{"a", 1}, {"b", 1}}, rep.Variants)
+
+	rep = stats.report("AAAAAA", day1.Truncate(time.Hour), day1.Truncate(time.Hour).Add(3*time.Hour), granularityHour)
+	require.Equal(t, int64(2), rep.Total)
+	require.Equal(t, []StatsBucket{
+		{time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), 1},
+		{time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), 1},
+		{time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), 0},
+	}, rep.Clicks)
+
+	// top referrers only
+	for i := range statsTopReferrers + 5 {
+		stats.add(day1, string(rune('a'+i))+".com", uaBrowser, "", "")
+	}
+	rep = stats.report("AAAAAA", day1.Truncate(24*time.Hour), day2, granularityDay)
+	require.Len(t, rep.Referrers, statsTopReferrers)
+	require.Equal(t, StatsItem{"a.com", 1}, rep.Referrers[1])
+}
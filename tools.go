@@ -8,90 +8,385 @@ package main
 // This file contains the configuration reading tools
 
 import (
-	"cmp"
+	"encoding"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Config - configuration structure
+// Options marked by `runtime:"true"` tag can be changed by configuration reload.
 type Config struct {
-	RedisAddrs     []string `required:"true"`          // Redis connection addresses
-	RedisPassword  string   `default:""`               // Redis connection password
-	TokenLength    int      `default:"6"`              // token length
-	Timeout        int      `default:"500"`            // New token creation timeout in ms
-	ListenHostPort string   `default:"localhost:8080"` // host and port to listen on
-	DefaultExp     int      `default:"1"`              // Default expiration of token (days)
-	ShortDomain    string   `default:"localhost:8080"` // Short domain name for short URL creation
-	Mode           uint     `default:"0"`              // Service mode (see README.md)
+	RedisAddrs        []string             `required:"true"`                         // Redis connection addresses
+	RedisPassword     string               `default:""`                              // Redis connection password
+	TokenLength       int                  `default:"6"`                             // token length
+	Timeout           int                  `default:"500" runtime:"true"`            // New token creation timeout in ms
+	ListenHostPort    string               `default:"localhost:8080"`                // host and port to listen on
+	DefaultExp        int                  `default:"1" runtime:"true"`              // Default expiration of token (days)
+	ShortDomain       string               `default:"localhost:8080" runtime:"true"` // Short domain name for short URL creation
+	Mode              ServiceMode          `default:"0" runtime:"true"`              // Service mode (see README.md)
+	TLSCertFile       string               `default:""`                              // TLS certificate file (HTTPS is served when it is set)
+	TLSKeyFile        string               `default:""`                              // TLS private key file
+	HTTPHostPort      string               `default:""`                              // host and port to listen on for HTTP to HTTPS redirect
+	AdminKey          string               `default:"" runtime:"true"`               // key for admin requests (they are disabled when it is empty)
+	InternalHostPort  string               `default:""`                              // host and port of internal listener (it is disabled when empty)
+	InternalMode      ServiceMode          `default:"admin-only" runtime:"true"`     // Service mode of internal listener
+	GeoIPFile         string               `default:""`                              // GeoIP database file (MaxMind format) for clicks statistics by countries and geo routing
+	WebhookURLs       []string             `default:"" runtime:"true"`               // URLs of webhooks for click events
+	WebhookSecret     string               `default:"" runtime:"true"`               // key for webhook requests signature
+	WebhookIPKey      string               `default:"" runtime:"true"`               // key for client IP hashing in click events (random when it is empty)
+	LifecycleWebhooks webhookSubscriptions `default:"" runtime:"true"`               // webhooks for token lifecycle events
+	RedirectCode      int                  `default:"302" runtime:"true"`            // default redirect status code
+	UsedLinkPage      pageFile             `default:"" runtime:"true"`               // HTML page file to respond on redirect by used up click limited link
+	PendingLinkPage   pageFile             `default:"" runtime:"true"`               // HTML page file to respond on redirect by not yet active link
+	FallbackURL       string               `default:"" runtime:"true"`               // default URL to redirect to after the token expiration
+	FallbackRetention int                  `default:"30" runtime:"true"`             // days to keep the token tombstone after the token expiration
+	PasswordAttempts  int                  `default:"5" runtime:"true"`              // maximum number of wrong password attempts per token in window
+	PasswordWindow    int                  `default:"15" runtime:"true"`             // window of wrong password attempts limit in minutes
+	TrustedProxies    trustedProxies       `default:"" runtime:"true"`               // CIDRs of proxies that are trusted to forward the client IP address
+	URLSchemes        []string             `default:"http,https" runtime:"true"`     // allowed schemes of long URLs
+	AllowListFile     domainList           `default:"" runtime:"true"`               // file of rules of allowed destination domains (all domains are allowed when it is empty)
+	BlockListFile     domainList           `default:"" runtime:"true"`               // file of rules of blocked destination domains
+	RecheckDomains    bool                 `default:"false" runtime:"true"`          // check the destination domains on redirect too
+	// forwarding header the trusted proxies set: X-Forwarded-For or Forwarded
+	ProxyHeader string `default:"X-Forwarded-For" runtime:"true"`
+	// user agent patterns of bots and crawlers (see README.md)
+	BotPatterns []string `default:"bot,crawler,spider,slurp,preview,facebookexternalhit,whatsapp,telegram,slack,vkshare,embedly,curl,wget,python,go-http-client,java/,okhttp,libwww,httpclient" runtime:"true"`
+	args        []string // command line arguments the configuration was read with (for reload)
 }
 
+// ServiceMode is a set of disabled service features
+type ServiceMode uint
+
 const (
 	// Service modes
-	disableRedirect    uint = 1 << iota // = 1 disable redirect request
-	disableShortener                    // = 2 disable request for short URL
-	disableExpire                       // = 4 disable expire request
-	disableUI                           // = 8 disable UI generation page
-	disableLengthCheck                  // = 16 disable token length check (during redirect)
+	disableRedirect    ServiceMode = 1 << iota // = 1 disable redirect request
+	disableShortener                           // = 2 disable request for short URL
+	disableExpire                              // = 4 disable expire request
+	disableUI                                  // = 8 disable UI generation page
+	disableLengthCheck                         // = 16 disable token length check (during redirect)
+	disableAdmin                               // = 32 disable admin requests
 	incorrectOption
 	TokenLength
-	envRedisAddrs         = "URLSHORTENER_REDISADDRS"
-	envRedisPassword      = "URLSHORTENER_REDISPASSWORD"
-	envTokenLength        = "URLSHORTENER_TOKENLENGTH"
-	envTimeout            = "URLSHORTENER_TIMEOUT"
-	envListenHostPort     = "URLSHORTENER_LISTENHOSTPORT"
-	envDefaultExp         = "URLSHORTENER_DEFAULTEXP"
-	envShortDomain        = "URLSHORTENER_SHORTDOMAIN"
-	envMode               = "URLSHORTENER_MODE"
-	defaultTokenLength    = "6"
-	defaultTimeout        = "500"
-	defaultListenHostPort = "localhost:8080"
-	defaultDefaultExp     = "1"
-	defaultShortDomain    = "localhost:8080"
-	defaultMode           = "0"
+	envPrefix            = "URLSHORTENER_"
+	envRedisAddrs        = envPrefix + "REDISADDRS"
+	envRedisPassword     = envPrefix + "REDISPASSWORD"
+	envTokenLength       = envPrefix + "TOKENLENGTH"
+	envTimeout           = envPrefix + "TIMEOUT"
+	envListenHostPort    = envPrefix + "LISTENHOSTPORT"
+	envDefaultExp        = envPrefix + "DEFAULTEXP"
+	envShortDomain       = envPrefix + "SHORTDOMAIN"
+	envMode              = envPrefix + "MODE"
+	envTLSCertFile       = envPrefix + "TLSCERTFILE"
+	envTLSKeyFile        = envPrefix + "TLSKEYFILE"
+	envHTTPHostPort      = envPrefix + "HTTPHOSTPORT"
+	envAdminKey          = envPrefix + "ADMINKEY"
+	envInternalHostPort  = envPrefix + "INTERNALHOSTPORT"
+	envInternalMode      = envPrefix + "INTERNALMODE"
+	envGeoIPFile         = envPrefix + "GEOIPFILE"
+	envBotPatterns       = envPrefix + "BOTPATTERNS"
+	envWebhookURLs       = envPrefix + "WEBHOOKURLS"
+	envWebhookSecret     = envPrefix + "WEBHOOKSECRET"
+	envWebhookIPKey      = envPrefix + "WEBHOOKIPKEY"
+	envLifecycleWebhooks = envPrefix + "LIFECYCLEWEBHOOKS"
+	envRedirectCode      = envPrefix + "REDIRECTCODE"
+	envUsedLinkPage      = envPrefix + "USEDLINKPAGE"
+	envPendingLinkPage   = envPrefix + "PENDINGLINKPAGE"
+	envFallbackURL       = envPrefix + "FALLBACKURL"
+	envFallbackRetention = envPrefix + "FALLBACKRETENTION"
+	envPasswordAttempts  = envPrefix + "PASSWORDATTEMPTS"
+	envPasswordWindow    = envPrefix + "PASSWORDWINDOW"
+	envTrustedProxies    = envPrefix + "TRUSTEDPROXIES"
+	envProxyHeader       = envPrefix + "PROXYHEADER"
+	envURLSchemes        = envPrefix + "URLSCHEMES"
+	envAllowListFile     = envPrefix + "ALLOWLISTFILE"
+	envBlockListFile     = envPrefix + "BLOCKLISTFILE"
+	envRecheckDomains    = envPrefix + "RECHECKDOMAINS"
 )
 
-// readConfig reads configuration from environment variables
-func readConfig() (*Config, error) {
-	addrs := []string{}
-	for s := range strings.SplitSeq(os.Getenv(envRedisAddrs), ",") {
-		s = strings.Trim(s, " \t")
-		if len(s) > 0 {
-			addrs = append(addrs, s)
+// readConfig reads configuration from (in order of priority): command line arguments,
+// environment variables, configuration file (passed via -config argument) and defaults
+// from Config structure tags.
+func readConfig(args ...string) (*Config, error) {
+	config := &Config{args: args}
+	v := reflect.ValueOf(config).Elem()
+	fields := configFields()
+
+	// prepare command line arguments: one argument per configuration field
+	fs := flag.NewFlagSet("URLshortener", flag.ContinueOnError)
+	configFile := fs.String("config", "", "configuration file (YAML)")
+	for _, f := range fields {
+		fs.String(strings.ToLower(f.Name), "", "overrides "+envPrefix+strings.ToUpper(f.Name))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// defaults
+	for _, f := range fields {
+		if d, ok := f.Tag.Lookup("default"); ok {
+			if err := setField(v.FieldByIndex(f.Index), d); err != nil {
+				return nil, fmt.Errorf("config error: wrong default value of %s: %w", f.Name, err)
+			}
 		}
 	}
-	if len(addrs) == 0 {
-		return nil, fmt.Errorf("config error: wrong or missed value of %s", envRedisAddrs)
+
+	// configuration file
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			field := v.FieldByNameFunc(func(n string) bool { return strings.ToLower(n) == name })
+			if !field.IsValid() || !field.CanSet() {
+				return nil, fmt.Errorf("config error: unknown option %s in %s", name, *configFile)
+			}
+			if err := setField(field, value); err != nil {
+				return nil, fmt.Errorf("config error: wrong value of %s in %s: %w", name, *configFile, err)
+			}
+		}
 	}
-	length, err := strconv.ParseUint(cmp.Or(os.Getenv(envTokenLength), defaultTokenLength), 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("config error: wrong value of %s: %w", envTokenLength, err)
+
+	// environment variables
+	for _, f := range fields {
+		name := envPrefix + strings.ToUpper(f.Name)
+		if value := os.Getenv(name); value != "" {
+			if err := setField(v.FieldByIndex(f.Index), value); err != nil {
+				return nil, fmt.Errorf("config error: wrong value of %s: %w", name, err)
+			}
+		}
 	}
-	timeout, err := strconv.ParseUint(cmp.Or(os.Getenv(envTimeout), defaultTimeout), 10, 64)
+
+	// command line arguments
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		field := v.FieldByNameFunc(func(n string) bool { return strings.ToLower(n) == fl.Name })
+		if err == nil && field.IsValid() && field.CanSet() {
+			if e := setField(field, fl.Value.String()); e != nil {
+				err = fmt.Errorf("config error: wrong value of -%s: %w", fl.Name, e)
+			}
+		}
+	})
 	if err != nil {
-		return nil, fmt.Errorf("config error: wrong value of %s: %w", envTimeout, err)
+		return nil, err
 	}
-	exp, err := strconv.ParseUint(cmp.Or(os.Getenv(envDefaultExp), defaultDefaultExp), 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("config error: wrong value of %s: %w", envDefaultExp, err)
+
+	// validation
+	for _, f := range fields {
+		field := v.FieldByIndex(f.Index)
+		if f.Tag.Get("required") == "true" && (field.IsZero() || field.Kind() == reflect.Slice && field.Len() == 0) {
+			return nil, fmt.Errorf("config error: wrong or missed value of %s", envPrefix+strings.ToUpper(f.Name))
+		}
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("config error: %s and %s must be set together", envTLSCertFile, envTLSKeyFile)
+	}
+	if config.HTTPHostPort != "" && config.TLSCertFile == "" {
+		return nil, fmt.Errorf("config error: %s requires %s and %s", envHTTPHostPort, envTLSCertFile, envTLSKeyFile)
+	}
+	if err := checkRedirectCode(config.RedirectCode); err != nil {
+		return nil, fmt.Errorf("config error: wrong value of %s: %w", envRedirectCode, err)
+	}
+	if config.FallbackURL != "" {
+		// the default fallback URL is normalized as the fallback URLs of links
+		fallback := LinkOptions{FallbackURL: config.FallbackURL}
+		err := fallback.check()
+		if err == nil {
+			err = fallback.normalize()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config error: wrong value of %s: %w", envFallbackURL, err)
+		}
+		config.FallbackURL = fallback.FallbackURL
+	}
+	config.ProxyHeader = http.CanonicalHeaderKey(strings.TrimSpace(config.ProxyHeader))
+	if config.ProxyHeader != headerXForwardedFor && config.ProxyHeader != headerForwarded {
+		return nil, fmt.Errorf("config error: wrong value of %s: unsupported header '%s'", envProxyHeader, config.ProxyHeader)
+	}
+	if len(config.URLSchemes) == 0 {
+		return nil, fmt.Errorf("config error: wrong or missed value of %s", envURLSchemes)
+	}
+	for i, scheme := range config.URLSchemes {
+		if !validScheme(scheme) {
+			return nil, fmt.Errorf("config error: wrong value of %s: wrong scheme '%s'", envURLSchemes, scheme)
+		}
+		config.URLSchemes[i] = strings.ToLower(scheme)
+	}
+
+	return config, nil
+}
+
+// configFields returns the configuration options fields
+func configFields() []reflect.StructField {
+	fields := []reflect.StructField{}
+	for _, f := range reflect.VisibleFields(reflect.TypeFor[Config]()) {
+		if f.IsExported() {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// checkRuntimeChanges returns error when the new configuration changes options that can't be changed at runtime
+func checkRuntimeChanges(current, config *Config) error {
+	cv, nv := reflect.ValueOf(current).Elem(), reflect.ValueOf(config).Elem()
+	for _, f := range configFields() {
+		if f.Tag.Get("runtime") != "true" && !reflect.DeepEqual(cv.FieldByIndex(f.Index).Interface(), nv.FieldByIndex(f.Index).Interface()) {
+			return fmt.Errorf("config reload rejected: %s can't be changed at runtime", f.Name)
+		}
 	}
-	mode, err := strconv.ParseUint(cmp.Or(os.Getenv(envMode), defaultMode), 10, 64)
+	return nil
+}
+
+// readConfigFile reads YAML configuration file and returns its values as strings by lower case option names
+func readConfigFile(name string) (map[string]string, error) {
+	buf, err := os.ReadFile(name)
 	if err != nil {
-		return nil, fmt.Errorf("config error: wrong value of %s: %w", envMode, err)
-	}
-	if uint(mode) >= incorrectOption {
-		return nil, fmt.Errorf("config error: wrong value of %s: %xH (%d)", envMode, mode, mode)
-	}
-
-	return &Config{
-		RedisAddrs:     addrs,
-		RedisPassword:  os.Getenv(envRedisPassword),
-		TokenLength:    int(length),
-		Timeout:        int(timeout),
-		ListenHostPort: cmp.Or(os.Getenv(envListenHostPort), defaultListenHostPort),
-		DefaultExp:     int(exp),
-		ShortDomain:    cmp.Or(os.Getenv(envShortDomain), defaultShortDomain),
-		Mode:           uint(mode),
-	}, nil
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+	raw := map[string]any{}
+	if err := yaml.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("config error: %s parsing error: %w", name, err)
+	}
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[strings.ToLower(k)] = strings.Join(items, ",")
+		case nil:
+			values[strings.ToLower(k)] = ""
+		default:
+			values[strings.ToLower(k)] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// setField parses the value according to the field type and sets it to the field
+func setField(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Uint:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		items := []string{}
+		for s := range strings.SplitSeq(value, ",") {
+			s = strings.Trim(s, " \t")
+			if len(s) > 0 {
+				items = append(items, s)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+var (
+	// modeFeatures are the names of service features that can be disabled by service mode
+	modeFeatures = []struct {
+		name string
+		mode ServiceMode
+	}{
+		{"redirect", disableRedirect},
+		{"shortener", disableShortener},
+		{"expire", disableExpire},
+		{"ui", disableUI},
+		{"lengthcheck", disableLengthCheck},
+		{"admin", disableAdmin},
+	}
+	// modePresets are the names of commonly used service modes
+	modePresets = map[string]ServiceMode{
+		"all":           0,
+		"redirect-only": disableShortener | disableExpire | disableUI | disableAdmin,
+		"api-only":      disableRedirect | disableUI,
+		"admin-only":    disableRedirect | disableShortener | disableExpire | disableUI,
+	}
+)
+
+// UnmarshalText parses service mode from comma separated list of items, each item is one of:
+// feature name to enable it (optionally prefixed by "+"), feature name prefixed by "-" to disable it,
+// preset name or number (sum of disabled features flags) to replace the mode by it.
+// Items are applied from left to right starting from the mode where all features are enabled.
+func (m *ServiceMode) UnmarshalText(text []byte) error {
+	mode := ServiceMode(0)
+	for item := range strings.SplitSeq(string(text), ",") {
+		item = strings.ToLower(strings.Trim(item, " \t"))
+		if item == "" {
+			continue
+		}
+		if n, err := strconv.ParseUint(item, 10, 64); err == nil {
+			if ServiceMode(n) >= incorrectOption {
+				return fmt.Errorf("unsupported mode value %xH (%d)", n, n)
+			}
+			mode = ServiceMode(n)
+			continue
+		}
+		if preset, ok := modePresets[item]; ok {
+			mode = preset
+			continue
+		}
+		disable := strings.HasPrefix(item, "-")
+		name := strings.TrimLeft(item, "+-")
+		found := false
+		for _, f := range modeFeatures {
+			if f.name == name {
+				found = true
+				if disable {
+					mode |= f.mode
+				} else {
+					mode &^= f.mode
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown mode item '%s'", item)
+		}
+	}
+	*m = mode
+	return nil
+}
+
+// String returns the list of all features where disabled ones are prefixed by "-"
+func (m ServiceMode) String() string {
+	items := make([]string, len(modeFeatures))
+	for i, f := range modeFeatures {
+		items[i] = f.name
+		if m&f.mode != 0 {
+			items[i] = "-" + f.name
+		}
+	}
+	return strings.Join(items, ",")
 }
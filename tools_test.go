@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/joho/godotenv"
@@ -80,13 +83,51 @@ func Test01Tools04WrongMode(t *testing.T) {
 	_, err := readConfig()
 
 	require.Error(t, err)
-	require.Equal(t, "config error: wrong value of URLSHORTENER_MODE: strconv.ParseUint: parsing \"z\": invalid syntax", err.Error())
-	t.Setenv("URLSHORTENER_MODE", fmt.Sprint(incorrectOption))
+	require.Equal(t, "config error: wrong value of URLSHORTENER_MODE: unknown mode item 'z'", err.Error())
+	t.Setenv("URLSHORTENER_MODE", fmt.Sprint(uint(incorrectOption)))
 
 	_, err = readConfig()
 
 	require.Error(t, err)
-	require.Equal(t, "config error: wrong value of URLSHORTENER_MODE: 20H (32)", err.Error())
+	require.Equal(t, "config error: wrong value of URLSHORTENER_MODE: unsupported mode value 40H (64)", err.Error())
+	t.Setenv("URLSHORTENER_MODE", "redirect,-unknown")
+
+	_, err = readConfig()
+
+	require.Error(t, err)
+	require.Equal(t, "config error: wrong value of URLSHORTENER_MODE: unknown mode item '-unknown'", err.Error())
+}
+
+func Test01Tools04NamedMode(t *testing.T) {
+	for value, mode := range map[string]ServiceMode{
+		"":                                0,
+		"4":                               disableExpire,
+		"all":                             0,
+		"redirect,shortener,-expire,-ui":  disableExpire | disableUI,
+		"-redirect, -LengthCheck":         disableRedirect | disableLengthCheck,
+		"redirect-only":                   disableShortener | disableExpire | disableUI | disableAdmin,
+		"redirect-only,+ui":               disableShortener | disableExpire | disableAdmin,
+		"admin-only":                      disableRedirect | disableShortener | disableExpire | disableUI,
+		"admin-only,+ui":                  disableRedirect | disableShortener | disableExpire,
+		"-admin":                          disableAdmin,
+		"api-only":                        disableRedirect | disableUI,
+		"-redirect,api-only,-lengthcheck": disableRedirect | disableUI | disableLengthCheck,
+		"31,expire":                       disableRedirect | disableShortener | disableUI | disableLengthCheck,
+		"-redirect,-shortener,-expire,-ui,-lengthcheck,redirect,shortener,expire,ui,lengthcheck": 0,
+	} {
+		var m ServiceMode
+		require.NoError(t, m.UnmarshalText([]byte(value)), value)
+		require.Equal(t, mode, m, value)
+	}
+	require.Equal(t, "redirect,shortener,expire,ui,lengthcheck,admin", ServiceMode(0).String())
+	require.Equal(t, "-redirect,shortener,expire,-ui,lengthcheck,admin", (disableRedirect | disableUI).String())
+
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	t.Setenv(envMode, "api-only")
+	c, err := readConfig()
+	require.NoError(t, err)
+	require.Equal(t, disableRedirect|disableUI, c.Mode)
+	require.Equal(t, disableRedirect|disableShortener|disableExpire|disableUI, c.InternalMode)
 }
 
 func Test01Tools05Success(t *testing.T) {
@@ -107,5 +148,178 @@ func Test01Tools05Success(t *testing.T) {
 	require.Equal(t, 777, c.Timeout)
 	require.Equal(t, 2, c.DefaultExp)
 	require.Equal(t, "<short.Domain>", c.ShortDomain)
-	require.Equal(t, uint(4), c.Mode)
+	require.Equal(t, disableExpire, c.Mode)
+}
+
+func Test01Tools06WrongTLS(t *testing.T) {
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	t.Setenv(envTLSCertFile, "cert.pem")
+	_, err := readConfig()
+	require.EqualError(t, err, "config error: URLSHORTENER_TLSCERTFILE and URLSHORTENER_TLSKEYFILE must be set together")
+	t.Setenv(envTLSCertFile, "")
+	t.Setenv(envHTTPHostPort, "localhost:80")
+	_, err = readConfig()
+	require.EqualError(t, err, "config error: URLSHORTENER_HTTPHOSTPORT requires URLSHORTENER_TLSCERTFILE and URLSHORTENER_TLSKEYFILE")
+	t.Setenv(envTLSCertFile, "cert.pem")
+	t.Setenv(envTLSKeyFile, "key.pem")
+	c, err := readConfig()
+	require.NoError(t, err)
+	require.Equal(t, "cert.pem", c.TLSCertFile)
+	require.Equal(t, "key.pem", c.TLSKeyFile)
+	require.Equal(t, "localhost:80", c.HTTPHostPort)
+}
+
+func Test01Tools07ConfigFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(name, []byte(`
+redisAddrs:
+  - file.host:6379
+  - file.backup:6379
+tokenLength: 7
+timeout: 600
+shortDomain: file.domain
+`), 0600))
+
+	t.Setenv(envRedisAddrs, "")
+	t.Setenv(envTimeout, "700")
+	c, err := readConfig("-config", name, "-shortdomain", "flag.domain")
+	require.NoError(t, err)
+	// file value
+	require.Equal(t, []string{"file.host:6379", "file.backup:6379"}, c.RedisAddrs)
+	require.Equal(t, 7, c.TokenLength)
+	// environment overrides file
+	require.Equal(t, 700, c.Timeout)
+	// argument overrides file
+	require.Equal(t, "flag.domain", c.ShortDomain)
+	// default
+	require.Equal(t, "localhost:8080", c.ListenHostPort)
+	require.Equal(t, 1, c.DefaultExp)
+
+	// argument overrides environment
+	c, err = readConfig("-config", name, "-timeout", "800")
+	require.NoError(t, err)
+	require.Equal(t, 800, c.Timeout)
+}
+
+func Test01Tools08WrongConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(envRedisAddrs, "localhost:6379")
+
+	_, err := readConfig("-config", filepath.Join(dir, "missed.yaml"))
+	require.ErrorContains(t, err, "config error: open ")
+
+	name := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(name, []byte("- not a map"), 0600))
+	_, err = readConfig("-config", name)
+	require.ErrorContains(t, err, "parsing error")
+
+	require.NoError(t, os.WriteFile(name, []byte("unknown: 1"), 0600))
+	_, err = readConfig("-config", name)
+	require.EqualError(t, err, "config error: unknown option unknown in "+name)
+
+	require.NoError(t, os.WriteFile(name, []byte("tokenlength: z"), 0600))
+	_, err = readConfig("-config", name)
+	require.EqualError(t, err, "config error: wrong value of tokenlength in "+name+": strconv.ParseUint: parsing \"z\": invalid syntax")
+
+	_, err = readConfig("-tokenlength", "-1")
+	require.EqualError(t, err, "config error: wrong value of -tokenlength: strconv.ParseUint: parsing \"-1\": invalid syntax")
+}
+
+func Test01Tools09RuntimeChanges(t *testing.T) {
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	current, err := readConfig()
+	require.NoError(t, err)
+	config, err := readConfig("-mode", "3", "-timeout", "100", "-defaultexp", "5", "-shortdomain", "short.domain", "-adminkey", "key")
+	require.NoError(t, err)
+	require.NoError(t, checkRuntimeChanges(current, config))
+	for _, args := range [][]string{
+		{"-redisaddrs", "other:6379"},
+		{"-redispassword", "pass"},
+		{"-tokenlength", "7"},
+		{"-listenhostport", "localhost:80"},
+	} {
+		config, err := readConfig(args...)
+		require.NoError(t, err)
+		require.ErrorContains(t, checkRuntimeChanges(current, config), "can't be changed at runtime")
+	}
+}
+
+func Test01Tools10WrongRedirectCode(t *testing.T) {
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	t.Setenv(envRedirectCode, "200")
+	_, err := readConfig()
+	require.EqualError(t, err, "config error: wrong value of URLSHORTENER_REDIRECTCODE: unsupported redirect status code 200")
+	t.Setenv(envRedirectCode, "308")
+	c, err := readConfig()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPermanentRedirect, c.RedirectCode)
+}
+
+func Test01Tools11WrongFallbackURL(t *testing.T) {
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	t.Setenv(envFallbackURL, "example.com")
+	_, err := readConfig()
+	require.EqualError(t, err, "config error: wrong value of URLSHORTENER_FALLBACKURL: wrong fallback URL 'example.com'")
+	t.Setenv(envFallbackURL, "https://user@example.com/expired")
+	_, err = readConfig()
+	require.ErrorContains(t, err, "userinfo_not_allowed")
+	t.Setenv(envFallbackURL, "https://Example.com:443/expired")
+	c, err := readConfig()
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/expired", c.FallbackURL)
+	require.Equal(t, 30, c.FallbackRetention)
+}
+
+func Test01Tools12TrustedProxies(t *testing.T) {
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	t.Setenv(envTrustedProxies, "10.0.0.0/8,wrong")
+	_, err := readConfig()
+	require.EqualError(t, err, "config error: wrong value of URLSHORTENER_TRUSTEDPROXIES: wrong trusted proxy 'wrong'")
+	t.Setenv(envTrustedProxies, "10.1.2.3/8, 192.0.2.1, ::1")
+	c, err := readConfig()
+	require.NoError(t, err)
+	require.Equal(t, trustedProxies{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("::1/128")}, c.TrustedProxies)
+	require.Equal(t, headerXForwardedFor, c.ProxyHeader)
+	t.Setenv(envProxyHeader, "forwarded")
+	c, err = readConfig()
+	require.NoError(t, err)
+	require.Equal(t, headerForwarded, c.ProxyHeader)
+	t.Setenv(envProxyHeader, "X-Real-IP")
+	_, err = readConfig()
+	require.EqualError(t, err, "config error: wrong value of URLSHORTENER_PROXYHEADER: unsupported header 'X-Real-Ip'")
+}
+
+func Test01Tools13URLSchemes(t *testing.T) {
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	c, err := readConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"http", "https"}, c.URLSchemes)
+	t.Setenv(envURLSchemes, "HTTPS, ftp")
+	c, err = readConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"https", "ftp"}, c.URLSchemes)
+	t.Setenv(envURLSchemes, "https,1http")
+	_, err = readConfig()
+	require.EqualError(t, err, "config error: wrong value of URLSHORTENER_URLSCHEMES: wrong scheme '1http'")
+	t.Setenv(envURLSchemes, ",")
+	_, err = readConfig()
+	require.EqualError(t, err, "config error: wrong or missed value of URLSHORTENER_URLSCHEMES")
+}
+
+func Test01Tools14DomainLists(t *testing.T) {
+	t.Setenv(envRedisAddrs, "localhost:6379")
+	file := filepath.Join(t.TempDir(), "blocked.txt")
+	t.Setenv(envBlockListFile, file)
+	_, err := readConfig()
+	require.ErrorContains(t, err, "config error: wrong value of URLSHORTENER_BLOCKLISTFILE: open "+file)
+	require.NoError(t, os.WriteFile(file, []byte("evil.example\n"), 0600))
+	t.Setenv(envRecheckDomains, "true")
+	c, err := readConfig()
+	require.NoError(t, err)
+	require.Len(t, c.BlockListFile.rules, 1)
+	require.Equal(t, "", c.AllowListFile.file)
+	require.True(t, c.RecheckDomains)
+	t.Setenv(envRecheckDomains, "sometimes")
+	_, err = readConfig()
+	require.ErrorContains(t, err, "config error: wrong value of URLSHORTENER_RECHECKDOMAINS")
 }
@@ -0,0 +1,148 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains long URL validation and normalization
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	neturl "net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	// long URL rejection codes
+	urlErrMalformed = "malformed_url"        // the URL can't be parsed
+	urlErrScheme    = "scheme_not_allowed"   // the URL scheme is not in the allowed schemes list
+	urlErrUserinfo  = "userinfo_not_allowed" // the URL contains user name or password
+	urlErrHost      = "invalid_host"         // the URL host is missing or it is not valid domain name or IP address
+	urlErrPort      = "invalid_port"         // the URL port is not valid port number
+)
+
+// defaultPorts are the default ports of schemes, they are removed from normalized URLs
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ftp": "21", "ws": "80", "wss": "443"}
+
+// hostProfile converts the internationalized domain names to punycode and validates them
+var hostProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+// urlError is the long URL rejection, it is sent in the response body
+type urlError struct {
+	Code    string `json:"error"`   // rejection code
+	Message string `json:"message"` // human readable rejection reason
+}
+
+// Error implements error interface
+func (e *urlError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// normalizeURL validates the long URL and returns its normalized form: the scheme and the host are lower
+// case, the internationalized domain name is converted to punycode and the default port is removed. The URL
+// without scheme is considered as HTTP URL, but its host has to be fully qualified domain name (or IP address or
+// localhost), so a garbage like "httpfoo" is not taken as host name. The returned error is *urlError.
+func normalizeURL(url string, schemes []string) (string, error) {
+	url = strings.TrimSpace(url)
+	implicit := !hasScheme(url)
+	switch {
+	case strings.HasPrefix(url, "//"):
+		url = "http:" + url
+	case implicit:
+		url = "http://" + url
+	}
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", &urlError{urlErrMalformed, fmt.Sprintf("URL parsing error: %v", err)}
+	}
+	// the scheme is always lower case after parsing
+	if !slices.Contains(schemes, u.Scheme) {
+		return "", &urlError{urlErrScheme, fmt.Sprintf("scheme '%s' is not allowed", u.Scheme)}
+	}
+	if u.User != nil {
+		return "", &urlError{urlErrUserinfo, "user name and password are not allowed in URL"}
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", &urlError{urlErrHost, "URL has no host"}
+	}
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", &urlError{urlErrHost, err.Error()}
+	}
+	if implicit && !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "", &urlError{urlErrHost, fmt.Sprintf("host '%s' of URL without scheme is not fully qualified domain name", host)}
+	}
+	port := u.Port()
+	if port != "" && !validPort(port) {
+		return "", &urlError{urlErrPort, fmt.Sprintf("wrong port '%s'", port)}
+	}
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	return u.String(), nil
+}
+
+// hasScheme returns true when the URL starts with the scheme. The URL like "host:port/path" is considered as
+// URL without scheme, the URLs like "javascript:..." or "mailto:..." have the scheme.
+func hasScheme(url string) bool {
+	scheme, rest, ok := strings.Cut(url, ":")
+	if !ok || !validScheme(scheme) {
+		return false
+	}
+	return strings.HasPrefix(rest, "//") || rest == "" || rest[0] < '0' || rest[0] > '9'
+}
+
+// validScheme returns true when the scheme consists of letter followed by letters, digits, '+', '-' and '.'
+func validScheme(scheme string) bool {
+	return scheme != "" && !strings.ContainsFunc(scheme, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.')
+	}) && !(scheme[0] >= '0' && scheme[0] <= '9' || scheme[0] == '+' || scheme[0] == '-' || scheme[0] == '.')
+}
+
+// validPort returns true when the port is number from 1 to 65535
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// normalizeHost returns the normalized IP address or the lower case domain name in punycode. Single label names
+// are valid as they are used in intranets and by containers orchestrators (for example, the short domain can be
+// a service name), but only in URLs with explicit scheme.
+func normalizeHost(host string) (string, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Zone() != "" {
+			return "", fmt.Errorf("IPv6 zone is not allowed in host '%s'", host)
+		}
+		return addr.Unmap().String(), nil
+	}
+	ascii, err := hostProfile.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", fmt.Errorf("wrong host '%s': %v", host, err)
+	}
+	return ascii, nil
+}
+
+// rejectURL logs the long URL rejection and responds with it
+func rejectURL(w http.ResponseWriter, rMess string, err error) {
+	log.Printf("%s: long URL is rejected: %v", rMess, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(err)
+}
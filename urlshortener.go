@@ -8,6 +8,8 @@ package main
 // This file contains the main routine
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -31,7 +33,10 @@ func main() {
 	// log the version
 	log.Printf("URLshortener %s", version)
 	// get exiting error
-	err := doMain()
+	err := doMain(os.Args[1:]...)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != http.ErrServerClosed {
 		panic(err)
 	} else {
@@ -40,9 +45,9 @@ func main() {
 }
 
 // doMain performs all preparation and starts server
-func doMain() error {
+func doMain(args ...string) error {
 	// get the configuration variables
-	config, err := readConfig()
+	config, err := readConfig(args...)
 	if err != nil {
 		return fmt.Errorf("configuration read error: %w", err)
 	}
@@ -80,9 +85,13 @@ func startService(config *Config, tokenDB TokenDB) error {
 	} else {
 		log.Println("initial health-check successfully passed")
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		// sleep until a signal is received.
-		<-c
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		// sleep until a termination signal is received, reload configuration on SIGHUP
+		for sig := <-c; sig == syscall.SIGHUP; sig = <-c {
+			if err := handler.reload(); err != nil {
+				log.Printf("configuration reload error: %v", err)
+			}
+		}
 	}
 	// Close service
 	handler.stop()
@@ -20,8 +20,24 @@ func Test20Main00WrongConfig(t *testing.T) {
 	require.Equal(t, "configuration read error: config error: wrong or missed value of URLSHORTENER_REDISADDRS", err.Error())
 }
 
+// setArgs replaces the command line arguments for the test duration
+func setArgs(t *testing.T, args ...string) {
+	saved := os.Args
+	os.Args = append([]string{"app"}, args...)
+	t.Cleanup(func() { os.Args = saved })
+}
+
+// try to pass wrong command line argument
+func Test20Main01WrongArgs(t *testing.T) {
+	err := doMain("-unknown")
+	require.EqualError(t, err, "configuration read error: flag provided but not defined: -unknown")
+	setArgs(t, "-h")
+	require.NotPanics(t, main)
+}
+
 // try to pass wrong addr of redis server
 func Test20Main05WrongDB(t *testing.T) {
+	setArgs(t)
 	t.Setenv("URLSHORTENER_REDISADDRS", "wrong.host:1234")
 	require.PanicsWithError(t, "database interface creation error: dial tcp: lookup wrong.host on 127.0.0.53:53: no such host", main)
 }
@@ -31,6 +47,8 @@ func Test20Main07WrongDB2(t *testing.T) {
 		ListenHostPort: "localhost:8080",
 		ShortDomain:    "localhost:8080",
 		Timeout:        500,
+		RedirectCode:   302,
+		URLSchemes:     []string{"http", "https"},
 		TokenLength:    6,
 	}
 	errDb := newMockDB()
@@ -72,6 +90,7 @@ func catchLog() func() string {
 
 // try to start service correctly
 func Test20Main20SuccessAndKill(t *testing.T) {
+	setArgs(t)
 	outF := catchLog()
 	envSet(t)
 
@@ -84,6 +103,11 @@ func Test20Main20SuccessAndKill(t *testing.T) {
 	require.Contains(t, out, "starting server at")
 	require.Contains(t, out, "URLshortener "+version)
 
+	outF = catchLog()
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	time.Sleep(time.Millisecond * 100)
+	require.Contains(t, outF(), "configuration reloaded")
+
 	outF = catchLog()
 	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
 
@@ -93,11 +117,7 @@ func Test20Main20SuccessAndKill(t *testing.T) {
 }
 
 func TestMainVersion(t *testing.T) {
-	args := os.Args
-	os.Args = []string{"app", "-v"}
-	defer func() {
-		os.Args = args
-	}()
+	setArgs(t, "-v")
 	outF := catchOutput()
 	main()
 	require.Contains(t, outF(), version)
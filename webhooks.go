@@ -0,0 +1,367 @@
+package main
+
+// URLshortener is a microservice to shorten long URLs
+// and to handle the redirection by generated short URLs.
+//
+// See details in README.md
+//
+// This file contains webhooks dispatcher
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookQueueSize     = 10000                  // maximum number of events waiting for delivery
+	webhookBatchSize     = 100                    // maximum number of events in one delivery
+	webhookFlushInterval = time.Second            // maximum delay of event delivery (without retries)
+	webhookRetries       = 3                      // number of delivery retries
+	webhookBackoff       = 500 * time.Millisecond // delay before the first retry, it is doubled for every next retry
+	webhookTimeout       = 5 * time.Second        // timeout of single delivery request
+	webhookSenderQueue   = 100                    // maximum number of deliveries waiting for single webhook
+	webhookSignature     = "X-URLshortener-Signature"
+
+	lifecycleQueueSize = 1000 // maximum number of lifecycle events waiting for delivery
+
+	// lifecycle events
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventExpired = "expired"
+	eventDeleted = "deleted"
+)
+
+// lifecycleEvents are all the lifecycle events
+var lifecycleEvents = []string{eventCreated, eventUpdated, eventExpired, eventDeleted}
+
+// clickEvent is the raw click event sent to webhooks
+type clickEvent struct {
+	Token     string    `json:"token"`                // token
+	Time      time.Time `json:"time"`                 // click time
+	Referrer  string    `json:"referrer,omitempty"`   // referrer
+	UserAgent string    `json:"user_agent,omitempty"` // user agent
+	IPHash    string    `json:"ip_hash,omitempty"`    // client IP hash (it is made by dispatcher)
+	Bot       bool      `json:"bot"`                  // true for bot hits
+	Variant   string    `json:"variant,omitempty"`    // variant the click was redirected to (for links with variants)
+	ip        net.IP    // client IP
+}
+
+// lifecycleEvent is the token lifecycle event sent to webhooks
+type lifecycleEvent struct {
+	Event   string    `json:"event"`              // event: created, updated, expired or deleted
+	Token   string    `json:"token"`              // token
+	Time    time.Time `json:"time"`               // event time
+	LongURL string    `json:"long_url,omitempty"` // long URL (for created and updated by URL change events)
+	Exp     int       `json:"exp,omitempty"`      // expiration in days (for created and updated by expiration change events)
+}
+
+// webhookSubscription is the lifecycle webhook with the events filter
+type webhookSubscription struct {
+	URL    string   // webhook URL
+	Events []string // events to send, all events are sent when it is empty
+}
+
+// webhookSubscriptions is the list of lifecycle webhooks
+type webhookSubscriptions []webhookSubscription
+
+// UnmarshalText parses comma separated list of webhooks. Every webhook is URL optionally prefixed by
+// the events filter: '+' separated list of events and '=', for example: created+deleted=https://host/hook
+func (ws *webhookSubscriptions) UnmarshalText(text []byte) error {
+	subs := webhookSubscriptions{}
+	for item := range strings.SplitSeq(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sub := webhookSubscription{URL: item}
+		if filter, url, ok := strings.Cut(item, "="); ok && !strings.Contains(filter, ":") {
+			for event := range strings.SplitSeq(filter, "+") {
+				if !slices.Contains(lifecycleEvents, event) {
+					return fmt.Errorf("unknown webhook event '%s'", event)
+				}
+				sub.Events = append(sub.Events, event)
+			}
+			sub.URL = url
+		}
+		if u, err := neturl.Parse(sub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("wrong webhook URL '%s'", sub.URL)
+		}
+		subs = append(subs, sub)
+	}
+	*ws = subs
+	return nil
+}
+
+// match returns true when the event has to be sent to the webhook
+func (s webhookSubscription) match(event string) bool {
+	return len(s.Events) == 0 || slices.Contains(s.Events, event)
+}
+
+// webhookDispatcher delivers click events to webhooks in background by batches and lifecycle events one by one.
+// Emitting never blocks the request: the event is dropped when the queue is full. Every webhook has its own
+// sender, so the slow webhook doesn't delay the deliveries to the others.
+type webhookDispatcher struct {
+	conf      func() *Config             // current configuration getter
+	client    *http.Client               // HTTP client for deliveries
+	queue     chan clickEvent            // click events waiting for delivery
+	lifecycle chan lifecycleEvent        // lifecycle events waiting for delivery
+	dropped   atomic.Int64               // number of click events dropped because of queue overflow
+	done      chan struct{}              // closed when the last events are delivered after stop
+	ipKey     string                     // random key of IP hashing when the IP key is not configured
+	mu        sync.Mutex                 // senders lock
+	senders   map[string]chan webhookJob // deliveries waiting for sender by webhook URL
+	sending   sync.WaitGroup             // running senders
+}
+
+// webhookJob is the delivery of request body to webhook
+type webhookJob struct {
+	body   []byte // request body
+	secret string // signature key
+	events string // delivered events description for logging
+}
+
+// newWebhookDispatcher returns new webhooks dispatcher
+func newWebhookDispatcher(conf func() *Config) *webhookDispatcher {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &webhookDispatcher{
+		conf:      conf,
+		client:    &http.Client{Timeout: webhookTimeout},
+		queue:     make(chan clickEvent, webhookQueueSize),
+		lifecycle: make(chan lifecycleEvent, lifecycleQueueSize),
+		done:      make(chan struct{}),
+		ipKey:     hex.EncodeToString(key),
+		senders:   map[string]chan webhookJob{},
+	}
+}
+
+// emit puts the click event into delivery queue when any webhook is configured
+func (d *webhookDispatcher) emit(sToken string, r *http.Request, bot bool, variant string) {
+	if len(d.conf().WebhookURLs) == 0 {
+		return
+	}
+	select {
+	case d.queue <- clickEvent{Token: sToken, Time: time.Now(), Referrer: r.Referer(), UserAgent: r.UserAgent(), Bot: bot, Variant: variant, ip: clientIP(r)}:
+	default:
+		d.dropped.Add(1)
+		log.Printf("webhook queue is full: click event of %s is dropped", sToken)
+	}
+}
+
+// notify puts the lifecycle event of token into delivery queue when any lifecycle webhook is configured
+func (d *webhookDispatcher) notify(event, sToken, longURL string, exp int) {
+	if len(d.conf().LifecycleWebhooks) == 0 {
+		return
+	}
+	select {
+	case d.lifecycle <- lifecycleEvent{event, sToken, time.Now(), longURL, exp}:
+	default:
+		log.Printf("lifecycle webhook queue is full: %s event of %s is dropped", event, sToken)
+	}
+}
+
+// run delivers click events by batches every interval or when the batch is full and lifecycle events
+// as soon as they are received until ctx is done, then it makes the last attempt to deliver the rest of events.
+func (d *webhookDispatcher) run(ctx context.Context, interval time.Duration) {
+	// the senders outlive ctx to deliver the last events, they are canceled in webhookTimeout after stop
+	sendCtx, cancelSend := context.WithCancel(context.WithoutCancel(ctx))
+	lifecycleDone := make(chan struct{})
+	go func() {
+		defer close(lifecycleDone)
+		d.runLifecycle(ctx, sendCtx)
+	}()
+	defer func() {
+		<-lifecycleDone
+		timer := time.AfterFunc(webhookTimeout, cancelSend)
+		d.closeSenders()
+		timer.Stop()
+		cancelSend()
+		close(d.done)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	batch := make([]clickEvent, 0, webhookBatchSize)
+	for {
+		select {
+		case e := <-d.queue:
+			if batch = append(batch, e); len(batch) == webhookBatchSize {
+				batch = d.deliver(sendCtx, batch)
+			}
+		case <-ticker.C:
+			batch = d.deliver(sendCtx, batch)
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-d.queue:
+					if batch = append(batch, e); len(batch) == webhookBatchSize {
+						batch = d.deliver(sendCtx, batch)
+					}
+				default:
+					d.deliver(sendCtx, batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends the batch to all configured webhooks and returns new empty batch. The IP addresses are hashed
+// by the configured IP key or by the random key of the process when it is not set. The webhook secret is never
+// used for hashing as every webhook knows it and it could reverse the hashes by trying all the addresses.
+func (d *webhookDispatcher) deliver(ctx context.Context, batch []clickEvent) []clickEvent {
+	if len(batch) == 0 {
+		return batch
+	}
+	config := d.conf()
+	key := cmp.Or(config.WebhookIPKey, d.ipKey)
+	for i := range batch {
+		batch[i].IPHash = hashIP(key, batch[i].ip)
+	}
+	body, _ := json.Marshal(batch)
+	for _, url := range config.WebhookURLs {
+		d.send(ctx, url, webhookJob{body, config.WebhookSecret, fmt.Sprintf("%d click events", len(batch))})
+	}
+	return make([]clickEvent, 0, webhookBatchSize)
+}
+
+// runLifecycle delivers lifecycle events until ctx is done, then it passes the rest of events to the senders
+// (they make deliveries within sendCtx)
+func (d *webhookDispatcher) runLifecycle(ctx, sendCtx context.Context) {
+	for {
+		select {
+		case e := <-d.lifecycle:
+			d.deliverLifecycle(sendCtx, e)
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-d.lifecycle:
+					d.deliverLifecycle(sendCtx, e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliverLifecycle sends the lifecycle event to all subscribed webhooks
+func (d *webhookDispatcher) deliverLifecycle(ctx context.Context, e lifecycleEvent) {
+	config := d.conf()
+	body, _ := json.Marshal(e)
+	for _, sub := range config.LifecycleWebhooks {
+		if sub.match(e.Event) {
+			d.send(ctx, sub.URL, webhookJob{body, config.WebhookSecret, fmt.Sprintf("%s event of %s", e.Event, e.Token)})
+		}
+	}
+}
+
+// send passes the delivery to the sender of webhook, the sender is started by the first delivery and it makes
+// the deliveries in order within ctx. The delivery is dropped when too many deliveries wait for the webhook.
+func (d *webhookDispatcher) send(ctx context.Context, url string, job webhookJob) {
+	d.mu.Lock()
+	jobs, ok := d.senders[url]
+	if !ok {
+		jobs = make(chan webhookJob, webhookSenderQueue)
+		d.senders[url] = jobs
+		d.sending.Add(1)
+		go func() {
+			defer d.sending.Done()
+			for job := range jobs {
+				if err := d.post(ctx, url, job.secret, job.body); err != nil {
+					log.Printf("webhook %s: %s not delivered: %v", url, job.events, err)
+				}
+			}
+		}()
+	}
+	d.mu.Unlock()
+	select {
+	case jobs <- job:
+	default:
+		log.Printf("webhook %s is too slow: %s dropped", url, job.events)
+	}
+}
+
+// closeSenders finishes the senders after the deliveries that are waiting for them
+func (d *webhookDispatcher) closeSenders() {
+	d.mu.Lock()
+	for url, jobs := range d.senders {
+		close(jobs)
+		delete(d.senders, url)
+	}
+	d.mu.Unlock()
+	d.sending.Wait()
+}
+
+// post sends the body to url, it retries with exponential backoff on errors and unsuccessful responses
+func (d *webhookDispatcher) post(ctx context.Context, url, secret string, body []byte) error {
+	var err error
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		if err = d.postOnce(ctx, url, secret, body); err == nil || attempt == webhookRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return fmt.Errorf("%w (retries canceled)", err)
+		}
+	}
+}
+
+// postOnce makes single delivery request
+func (d *webhookDispatcher) postOnce(ctx context.Context, url, secret string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(webhookSignature, "sha256="+sign(secret, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// wait waits until the last batch is delivered
+func (d *webhookDispatcher) wait() {
+	<-d.done
+}
+
+// sign returns hex encoded HMAC-SHA256 signature of the body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashIP returns hex encoded keyed hash of IP address, so the address itself is never sent
+func hashIP(secret string, ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return sign(secret, ip)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver is a test webhook that fails first `fails` requests
+type webhookReceiver struct {
+	mu     sync.Mutex
+	fails  int
+	calls  int
+	events []clickEvent
+	signOK bool
+	srv    *httptest.Server
+}
+
+func newWebhookReceiver(t *testing.T, secret string, fails int) *webhookReceiver {
+	wr := &webhookReceiver{fails: fails, signOK: true}
+	wr.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		wr.calls++
+		if wr.calls <= wr.fails {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		wr.signOK = wr.signOK && r.Header.Get(webhookSignature) == "sha256="+sign(secret, body)
+		events := []clickEvent{}
+		require.NoError(t, json.Unmarshal(body, &events))
+		wr.events = append(wr.events, events...)
+	}))
+	t.Cleanup(wr.srv.Close)
+	return wr
+}
+
+func (wr *webhookReceiver) received() []clickEvent {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return append([]clickEvent{}, wr.events...)
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	wr := newWebhookReceiver(t, "secret", 1)
+	config := &Config{WebhookURLs: []string{wr.srv.URL}, WebhookSecret: "secret", WebhookIPKey: "ipkey"}
+	d := newWebhookDispatcher(func() *Config { return config })
+	ctx, cancel := context.WithCancel(context.Background())
+	go d.run(ctx, 10*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/AAAAAA", nil)
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.RemoteAddr = "192.0.2.1:1234"
+	d.emit("AAAAAA", req, true, "")
+	d.emit("BBBBBB", req, false, "")
+
+	// the first delivery fails and it is retried after backoff
+	require.Eventually(t, func() bool { return len(wr.received()) == 2 }, 3*time.Second, 10*time.Millisecond)
+	events := wr.received()
+	require.Equal(t, "AAAAAA", events[0].Token)
+	require.True(t, events[0].Bot)
+	require.Equal(t, "https://example.com/", events[0].Referrer)
+	require.Equal(t, "curl/8.0", events[0].UserAgent)
+	require.Equal(t, hashIP("ipkey", net.ParseIP("192.0.2.1")), events[0].IPHash)
+	require.NotContains(t, events[0].IPHash, "192.0.2.1")
+	require.Equal(t, "BBBBBB", events[1].Token)
+	require.False(t, events[1].Bot)
+	require.True(t, wr.signOK)
+
+	// the rest of events are delivered on stop
+	d.emit("CCCCCC", req, false, "")
+	cancel()
+	d.wait()
+	require.Len(t, wr.received(), 3)
+	require.Zero(t, d.dropped.Load())
+}
+
+func TestWebhookDispatcherSlowWebhook(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	wr := newWebhookReceiver(t, "secret", 0)
+	config := &Config{WebhookURLs: []string{slow.URL, wr.srv.URL}, WebhookSecret: "secret"}
+	d := newWebhookDispatcher(func() *Config { return config })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.run(ctx, 10*time.Millisecond)
+
+	// the slow webhook doesn't delay the others
+	req := httptest.NewRequest(http.MethodGet, "/AAAAAA", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	d.emit("AAAAAA", req, false, "")
+	require.Eventually(t, func() bool { return len(wr.received()) == 1 }, time.Second, 10*time.Millisecond)
+	d.emit("BBBBBB", req, false, "")
+	require.Eventually(t, func() bool { return len(wr.received()) == 2 }, time.Second, 10*time.Millisecond)
+
+	// IP addresses are hashed by random key when the IP key is not set (never by the secret known to webhooks)
+	events := wr.received()
+	require.Equal(t, hashIP(d.ipKey, net.ParseIP("192.0.2.1")), events[0].IPHash)
+	require.NotEqual(t, hashIP("", net.ParseIP("192.0.2.1")), events[0].IPHash)
+	require.NotEqual(t, hashIP("secret", net.ParseIP("192.0.2.1")), events[0].IPHash)
+	require.NotEqual(t, d.ipKey, newWebhookDispatcher(func() *Config { return config }).ipKey)
+}
+
+func TestWebhookDispatcherNoWebhooks(t *testing.T) {
+	d := newWebhookDispatcher(func() *Config { return &Config{} })
+	d.emit("AAAAAA", httptest.NewRequest(http.MethodGet, "/AAAAAA", nil), false, "")
+	require.Empty(t, d.queue)
+}
+
+func TestWebhookDispatcherQueueOverflow(t *testing.T) {
+	config := &Config{WebhookURLs: []string{"http://localhost:1"}}
+	d := newWebhookDispatcher(func() *Config { return config })
+	req := httptest.NewRequest(http.MethodGet, "/AAAAAA", nil)
+	for range webhookQueueSize + 10 {
+		d.emit("AAAAAA", req, false, "")
+	}
+	require.Len(t, d.queue, webhookQueueSize)
+	require.Equal(t, int64(10), d.dropped.Load())
+}
+
+func TestWebhookDispatcherRetries(t *testing.T) {
+	wr := newWebhookReceiver(t, "", webhookRetries+1)
+	d := newWebhookDispatcher(func() *Config { return &Config{} })
+	start := time.Now()
+	require.Error(t, d.post(context.Background(), wr.srv.URL, "", []byte("[]")))
+	require.Equal(t, webhookRetries+1, wr.calls)
+	require.GreaterOrEqual(t, time.Since(start), webhookBackoff*(1<<webhookRetries-1))
+
+	// retries are canceled with context
+	wr.calls = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, d.post(ctx, wr.srv.URL, "", []byte("[]")))
+	require.Zero(t, wr.calls)
+}
+
+func TestSignAndHashIP(t *testing.T) {
+	require.Equal(t, "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8", sign("key", []byte("The quick brown fox jumps over the lazy dog")))
+	require.Empty(t, hashIP("key", nil))
+	require.NotEqual(t, hashIP("key", net.ParseIP("192.0.2.1")), hashIP("other", net.ParseIP("192.0.2.1")))
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	var subs webhookSubscriptions
+	require.NoError(t, subs.UnmarshalText([]byte(" http://host/all?a=b , created+deleted=https://host:8443/hook,")))
+	require.Equal(t, webhookSubscriptions{
+		{URL: "http://host/all?a=b"},
+		{URL: "https://host:8443/hook", Events: []string{eventCreated, eventDeleted}},
+	}, subs)
+	require.True(t, subs[0].match(eventExpired))
+	require.True(t, subs[1].match(eventDeleted))
+	require.False(t, subs[1].match(eventUpdated))
+
+	require.NoError(t, subs.UnmarshalText(nil))
+	require.Empty(t, subs)
+
+	for _, wrong := range []string{"created+removed=http://host/hook", "host/hook", "ftp://host/hook", "created=", "http://"} {
+		require.Error(t, subs.UnmarshalText([]byte(wrong)), wrong)
+	}
+}